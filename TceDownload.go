@@ -2,242 +2,1729 @@ package main
 
 import (
 	"bufio"
-	"crypto/md5"
-	"encoding/hex"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/JordanHiggins/TceDownload/tce"
 )
 
 var (
-	archFlag    = flag.String("arch", "x86", "The architecture for which to get extensions.")
-	helpFlag    = flag.Bool("help", false, "Shows this help message.")
-	kernelFlag  = flag.String("kernel", "4.8.17-tinycore", "The name of the kernel to use for kernel-specific extensions.")
-	outFlag     = flag.String("out", "tce/%v/%a", "The directory to which to output files.")
-	versionFlag = flag.String("version", "8.x", "The Tiny Core Linux version for which to get extensions.")
+	absentTtlFlag        = flag.Duration("absent-ttl", 0, "How long to trust that an extension missing from the mirror is still absent before checking again. (default forever)")
+	archFlag             = flag.String("arch", "", "The architecture for which to get extensions: x86, x86_64, armv6, armv7 or aarch64. (default the host architecture)")
+	archAllowUnknownFlag = flag.Bool("arch-allow-unknown", false, "Allows an -arch value that is not a known Tiny Core Linux architecture, for custom mirrors.")
+	autoMirrorFlag       = flag.Bool("auto-mirror", false, "Probes every mirror at once on startup and tries them quickest first, with those that fail the probe last.")
+	benchFlag            = flag.Bool("bench", false, "Times how quickly each mirror serves the repository index, then tries the mirrors fastest first.")
+	depsOnlyFlag         = flag.Bool("deps-only", false, "Only gets the dependencies of the named extensions, not the extensions themselves.")
+	caCertFlag           = flag.String("cacert", "", "A PEM file of CA certificates to trust for mirrors in addition to the system's, e.g. for an internal mirror.")
+	caCertOnlyFlag       = flag.Bool("cacert-only", false, "Only trusts the certificates given with -cacert, not the system's.")
+	confirmSizeFlag      = flag.String("confirm-size", "100M", "The size above which downloading an extension and its dependencies must be confirmed, e.g. 500M, unless -yes is given.")
+	dirModeFlag          = flag.String("dir-mode", "0755", "The permissions, in octal, of the output directories created.")
+	dotFlag              = flag.String("dot", "", "A file to which to write the resolved dependency graph in Graphviz DOT format.")
+	dryRunFlag           = flag.Bool("dry-run", false, "Resolves dependencies and lists what would be downloaded without downloading it.")
+	estimateFlag         = flag.Bool("estimate", false, "Like -dry-run, but also reports the total size of what would be downloaded.")
+	excludeFlag          = listVar("exclude", "An extension not to get when it is required by another, along with any dependencies only it requires. May be repeated or comma-separated.")
+	excludeFileFlag      = flag.String("exclude-file", "", "A file listing extensions to exclude, one per line.")
+	forceFlag            = flag.Bool("force", false, "Re-downloads every file, even those already present or known to be absent.")
+	fromFileFlag         = flag.String("from-file", "", "A file listing extensions to get, one per line, or - for standard input.")
+	graphJsonFlag        = flag.String("graph-json", "", "A file to which to write the resolved dependency graph as JSON.")
+	hashFlag             = flag.String("hash", "md5", "The checksum algorithm with which to verify extensions: md5, sha256 or auto to use the strongest one published.")
+	helpFlag             = flag.Bool("help", false, "Shows this help message.")
+	httpsFlag            = flag.Bool("https", true, "Downloads files over HTTPS, falling back to HTTP if the connection fails.")
+	ignoreCaseFlag       = flag.Bool("ignore-case", false, "Corrects the case of extension names to match the repository index, e.g. firefox for Firefox.")
+	ignoreSpaceFlag      = flag.Bool("ignore-space", false, "Downloads even if there does not appear to be enough free disk space.")
+	infoFlag             = flag.Bool("info", false, "Also prints the description of each extension found by search, read from its .info file.")
+	insecureFlag         = flag.Bool("insecure", false, "Skips verification of mirrors' TLS certificates, e.g. for an internal mirror with a self-signed certificate. Unsafe.")
+	jobsFlag             = flag.Int("jobs", 1, "The number of extensions to download, or with -verify to hash, concurrently.")
+	jsonFlag             = flag.Bool("json", false, "Prints a JSON summary of the run instead of progress messages.")
+	keepGoingFlag        = flag.Bool("keep-going", false, "Carries on with the remaining dependencies of an extension when one fails, reporting every failure.")
+	kernelFlag           = flag.String("kernel", "", "The name of the kernel to use for kernel-specific extensions, or a comma-separated list to get them for several kernels. (default the running kernel)")
+	lockedFlag           = flag.String("locked", "", "A JSON file written by -write-lock whose checksums to insist on instead of those published by the mirror.")
+	maxConnsPerHostFlag  = flag.Int("max-conns-per-host", 0, "The maximum number of connections open at once to each mirror host, e.g. to stay within its rate limits with -jobs. (default unlimited)")
+	maxDepthFlag         = flag.Int("max-depth", 0, "How many levels of dependencies to get below the named extensions. (default unlimited)")
+	mirrorFlag           = listVar("mirror", "A mirror from which to download files, optionally with a path template. May be repeated or comma-separated to try several mirrors in order. (default $TCE_MIRROR or tinycorelinux.net)")
+	modeFlag             = flag.String("mode", "0644", "The permissions, in octal, of the files created in the output directory.")
+	noAbsentCacheFlag    = flag.Bool("no-absent-cache", false, "Never records or trusts files known to be missing from the mirror.")
+	noDepsFlag           = flag.Bool("no-deps", false, "Only gets the named extensions, without their dependencies.")
+	noHttpFallbackFlag   = flag.Bool("no-http-fallback", false, "Never falls back to HTTP when an HTTPS connection fails.")
+	noLockFlag           = flag.Bool("no-lock", false, "Does not lock the output directory against other runs.")
+	noMagicCheckFlag     = flag.Bool("no-magic-check", false, "Accepts downloaded extensions that do not look like squashfs images.")
+	noRepairFlag         = flag.Bool("no-repair", false, "Fails immediately on a checksum mismatch instead of re-downloading the extension.")
+	offlineFlag          = flag.Bool("offline", false, "Only uses files already in the output directory, reporting every one that is missing instead of downloading it.")
+	onbootFlag           = flag.String("onboot", "", "A file to which to write the resolved extensions in load order, e.g. onboot.lst.")
+	outFlag              = flag.String("out", "tce/%v/%a", "The directory to which to output files. %v, %a, %d and %k are replaced by the version, architecture, date and, for kernel-specific extensions, kernel.")
+	passwordFlag         = flag.String("password", "", "The password with which to authenticate to mirrors using HTTP basic authentication, with -user.")
+	proxyFlag            = flag.String("proxy", "", "An http://, https://, socks5:// or socks5h:// proxy through which to make all requests. (default $HTTP_PROXY or $HTTPS_PROXY)")
+	pruneFlag            = flag.Bool("prune", false, "Deletes extensions in the output directory that the given extensions do not depend on.")
+	quietFlag            = flag.Bool("quiet", false, "Only prints errors and the result for each extension.")
+	rateFlag             = flag.String("rate", "", "The maximum total download rate in bytes per second, e.g. 500k or 2M.")
+	refreshFlag          = flag.Bool("refresh", false, "Ignores the record of previously verified files and re-hashes them.")
+	requestTimeoutFlag   = flag.Duration("request-timeout", 0, "The maximum time allowed for a single request, including its transfer, before it is retried. (default unlimited)")
+	requireChecksumFlag  = flag.Bool("require-checksum", false, "Fails any extension for which the mirror publishes no checksum, instead of warning about it.")
+	retriesFlag          = flag.Int("retries", 3, "The number of times to retry a download that fails with a transient error.")
+	retryDelayFlag       = flag.Duration("retry-delay", 500*time.Millisecond, "The delay before the first retry, doubled for each further attempt.")
+	tarFlag              = flag.String("tar", "", "A tar file to which to also write every extension retrieved, with its checksum and dependency files.")
+	timeoutFlag          = flag.Duration("timeout", 0, "The maximum time allowed for the whole run. (default unlimited)")
+	treeFlag             = flag.Bool("tree", false, "Prints the dependency tree of each extension.")
+	updateFlag           = flag.Bool("update", false, "Re-checks every file already present with a conditional request and only downloads those changed on the mirror.")
+	updateIndexFlag      = flag.Bool("update-index", false, "Downloads the repository index again, replacing the copy cached in the output directory.")
+	userFlag             = flag.String("user", "", "The user name with which to authenticate to mirrors using HTTP basic authentication. Credentials may also be given in a -mirror URL.")
+	userAgentFlag        = flag.String("user-agent", tce.DefaultUserAgent, "The User-Agent header sent with every request.")
+	verboseFlag          = flag.Bool("verbose", false, "Also prints file paths, download URLs, redirect targets and hash comparisons.")
+	verifyFlag           = flag.Bool("verify", false, "Checks every extension already in the output directory against its checksum instead of downloading anything.")
+	versionFlag          = flag.String("version", "8.x", "The Tiny Core Linux version for which to get extensions.")
+	withInfoFlag         = flag.Bool("with-info", false, "Also downloads the .info file of each extension, describing it.")
+	withListFlag         = flag.Bool("with-list", false, "Also downloads the .list file of each extension, listing the files it installs.")
+	writeLockFlag        = flag.String("write-lock", "", "A JSON file to which to write every extension retrieved with its checksum and the mirror it came from, e.g. tce.lock.")
+	yesFlag              = flag.Bool("yes", false, "Downloads without asking for confirmation, however large the download.")
 )
 
-var baseDir string
-var checked = map[string]struct{}{}
+var logLevel = tce.LogNormal
+var output io.Writer = os.Stdout
+var outputMutex sync.Mutex
 
-func calculateHash(reader io.Reader) (string, error) {
-	hash := md5.New()
+// startDate is the date substituted for %d, taken once so that a run which
+// crosses midnight still writes to a single directory.
+var startDate = time.Now().Format("2006-01-02")
 
-	_, err := io.Copy(hash, reader)
-	if err != nil {
-		return "", err
+func logf(level tce.LogLevel, format string, args ...interface{}) {
+	if level > logLevel {
+		return
 	}
 
-	raw := hash.Sum(nil)
-	return hex.EncodeToString(raw), nil
+	outputMutex.Lock()
+	fmt.Fprintf(output, format, args...)
+	outputMutex.Unlock()
 }
 
-func getBaseDir() string {
-	return strings.NewReplacer(
-		"%a", *archFlag,
-		"%v", *versionFlag,
-	).Replace(*outFlag)
-}
+type listFlag []string
 
-func openFile(fileName string) (io.ReadCloser, error) {
-	filePath := filepath.Join(baseDir, fileName)
+func listVar(name string, usage string) *listFlag {
+	list := &listFlag{}
+	flag.Var(list, name, usage)
+	return list
+}
 
-	fmt.Printf("Checking %v... ", fileName)
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
 
-	file, err := os.Open(filePath)
-	if err == nil {
-		info, err := file.Stat()
-		if err != nil {
-			file.Close()
-			return nil, err
+func (list *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			*list = append(*list, item)
 		}
+	}
 
-		if info.Size() > 0 {
-			fmt.Println("Present!")
-			return file, nil
-		} else {
-			fmt.Println("Known absent!")
-			return nil, nil
+	return nil
+}
+
+type runSummary struct {
+	BaseDir    string                `json:"baseDir"`
+	Extensions []extensionSummary    `json:"extensions"`
+	Estimate   *tce.SizeEstimate     `json:"estimate,omitempty"`
+	Verified   []tce.VerifyResult    `json:"verified,omitempty"`
+	Transfers  *tce.TransferStats    `json:"transfers,omitempty"`
+	Matches    []searchResult        `json:"matches,omitempty"`
+	Stats      *tce.DirectoryStats   `json:"stats,omitempty"`
+	Diff       []tce.DiffResult      `json:"diff,omitempty"`
+	Bench      []tce.MirrorBenchmark `json:"bench,omitempty"`
+	Probe      []tce.MirrorBenchmark `json:"probe,omitempty"`
+	Shared     *sharedSummary        `json:"shared,omitempty"`
+}
+
+// sharedSummary compares the dependencies the requested extensions need
+// together with what they would need one by one, counting shared dependencies
+// repeatedly.
+type sharedSummary struct {
+	Unique     int                `json:"unique"`
+	Separate   int                `json:"separate"`
+	MostShared []sharedDependency `json:"mostShared"`
+}
+
+type sharedDependency struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// maxMostShared caps how many of the most shared dependencies are listed.
+const maxMostShared = 5
+
+type searchResult struct {
+	tce.IndexEntry
+	Description string `json:"description,omitempty"`
+}
+
+type extensionSummary struct {
+	Name         string           `json:"name"`
+	Status       string           `json:"status"`
+	Dependencies []string         `json:"dependencies"`
+	Downloaded   []string         `json:"downloaded"`
+	Present      []string         `json:"present"`
+	Files        []tce.FileResult `json:"files"`
+	Kernel       string           `json:"kernel,omitempty"`
+	Error        string           `json:"error,omitempty"`
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	// The null device is a character device too, but nobody is there to
+	// answer.
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// flagGiven returns true if the named flag was set on the command line rather
+// than left at its default.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
 		}
+	})
+
+	return given
+}
+
+func parseSize(value string) (int64, error) {
+	multiplier := 1.0
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
 	}
 
-	if !os.IsNotExist(err) {
-		fmt.Println("Failed!")
-		return nil, err
+	if multiplier != 1 {
+		value = value[:len(value)-1]
 	}
 
-	fmt.Println("Absent!")
-	fmt.Printf("Downloading %v... ", fileName)
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("Invalid size: %v", value)
+	}
+
+	return int64(size * multiplier), nil
+}
+
+// confirmDownload returns a function that asks on the terminal before
+// downloading more than limit bytes for an extension. Without a terminal to
+// ask on, such downloads are refused rather than waiting for an answer.
+func confirmDownload(limit int64) func(string, tce.SizeEstimate) bool {
+	interactive := isTerminal(os.Stdin)
+	stdin := bufio.NewReader(os.Stdin)
 
-	fileUrl := fmt.Sprintf("http://tinycorelinux.net/%v/%v/tcz/%v", *versionFlag, *archFlag, fileName)
+	return func(name string, estimate tce.SizeEstimate) bool {
+		if estimate.DownloadBytes <= limit {
+			return true
+		}
+
+		size := tce.FormatSize(estimate.DownloadBytes)
+		if !interactive {
+			logf(tce.LogQuiet, "Not downloading %v files (%v) for %v without confirmation! Use -yes to download anyway.\n",
+				estimate.DownloadFiles, size, name)
+			return false
+		}
+
+		fmt.Fprintf(os.Stderr, "Download %v files (~%v) for %v? [y/N] ", estimate.DownloadFiles, size, name)
+		answer, _ := stdin.ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+}
 
-	response, err := http.Get(fileUrl)
+func parseProxy(value string) (*url.URL, error) {
+	proxy, err := url.Parse(value)
 	if err != nil {
-		fmt.Println("Failed!")
 		return nil, err
 	}
-	defer response.Body.Close()
 
-	if (response.StatusCode < 200 || response.StatusCode >= 300) && response.StatusCode != 404 {
-		fmt.Println("Failed!")
-		return nil, fmt.Errorf("Server returned: %v", response.Status)
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme: %v", proxy.Scheme)
 	}
 
-	file, err = os.Create(filePath)
-	if err != nil {
-		fmt.Println("Failed!")
-		return nil, err
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("Missing proxy host: %v", value)
 	}
 
-	if response.StatusCode == 404 {
-		fmt.Println("OK!")
-		return nil, nil
+	return proxy, nil
+}
+
+func parseMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid permissions: %v", value)
 	}
 
-	_, err = io.Copy(file, response.Body)
-	if err != nil {
-		file.Close()
-		fmt.Println("Failed!")
-		return nil, err
+	return os.FileMode(mode), nil
+}
+
+// makeDirectory creates a directory and any missing parents with the given
+// mode, which unlike with os.MkdirAll does not depend on the umask.
+func makeDirectory(path string, mode os.FileMode) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("Not a directory: %v", path)
+		}
+
+		return nil
+	}
+
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	parent := filepath.Dir(path)
+	if parent != path {
+		err = makeDirectory(parent, mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Mkdir(path, mode)
+	if err != nil && !os.IsExist(err) {
+		return err
 	}
 
-	_, err = file.Seek(0, 0)
+	return os.Chmod(path, mode)
+}
+
+func loadCACerts(path string, systemPool bool) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
 	if err != nil {
-		file.Close()
-		fmt.Println("Failed!")
 		return nil, err
 	}
 
-	fmt.Println("OK!")
-	return file, nil
+	pool := x509.NewCertPool()
+	if systemPool {
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %v", path)
+	}
+
+	return pool, nil
 }
 
-func getChecksum(name string) (string, error) {
-	file, err := openFile(name + ".tcz.md5.txt")
+func detectKernel() (string, error) {
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
 	if err != nil {
 		return "", err
 	}
 
-	if file == nil {
-		return "", nil
+	kernel := strings.TrimSpace(string(release))
+	if kernel == "" {
+		return "", errors.New("Empty kernel release")
+	}
+
+	return kernel, nil
+}
+
+func getArch() string {
+	if *archFlag != "" {
+		return *archFlag
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanWords)
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	case "arm":
+		return "armv7"
+	default:
+		return "x86"
+	}
+}
 
-	if scanner.Scan() {
-		return scanner.Text(), nil
-	} else {
-		return "", nil
+func isKnownArch(arch string) bool {
+	for _, known := range tce.Architectures {
+		if arch == known {
+			return true
+		}
 	}
+
+	return false
 }
 
-func getDependencies(name string) ([]string, error) {
-	file, err := openFile(name + ".tcz.dep")
-	if err != nil {
-		return nil, err
+func getBaseDir(arch string, kernel string) string {
+	return filepath.Clean(strings.NewReplacer(
+		"%a", arch,
+		"%d", startDate,
+		"%k", kernel,
+		"%v", *versionFlag,
+	).Replace(*outFlag))
+}
+
+func getMirrors() []string {
+	if len(*mirrorFlag) > 0 {
+		return *mirrorFlag
 	}
 
-	if file == nil {
-		return []string{}, nil
+	env := listFlag{}
+	env.Set(os.Getenv("TCE_MIRROR"))
+	if len(env) > 0 {
+		return env
 	}
-	defer file.Close()
 
-	lines := []string{}
-	scanner := bufio.NewScanner(file)
+	return []string{tce.DefaultMirror}
+}
+
+func readExtensionList(reader io.Reader) ([]string, error) {
+	names := []string{}
+	scanner := bufio.NewScanner(reader)
 
 	for scanner.Scan() {
-		line := scanner.Text()
-		if line != "" {
-			line = strings.TrimSuffix(line, ".tcz")
-			lines = append(lines, line)
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			names = append(names, line)
 		}
 	}
 
-	return lines, nil
+	return names, scanner.Err()
 }
 
-func getExtension(name string) error {
-	name = strings.Replace(name, "KERNEL", *kernelFlag, -1)
+func getExclusions() ([]string, error) {
+	names := append([]string{}, *excludeFlag...)
 
-	if _, ok := checked[name]; ok {
-		return nil
+	if *excludeFileFlag != "" {
+		file, err := os.Open(*excludeFileFlag)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		fileNames, err := readExtensionList(file)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, fileNames...)
 	}
 
-	file, err := openFile(name + ".tcz")
-	if err != nil {
-		return err
+	return names, nil
+}
+
+func getExtensionNames() ([]string, error) {
+	names := []string{}
+	readStdin := *fromFileFlag == "-"
+
+	if *fromFileFlag != "" && !readStdin {
+		file, err := os.Open(*fromFileFlag)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		names, err = readExtensionList(file)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if file == nil {
-		return fmt.Errorf("Extension not found: %v", name)
+	for _, arg := range flag.Args() {
+		if arg == "-" {
+			readStdin = true
+		} else {
+			names = append(names, arg)
+		}
 	}
-	defer file.Close()
 
-	expectedHash, err := getChecksum(name)
-	if err != nil {
-		return err
+	if *fromFileFlag == "" && flag.NArg() == 0 && !isTerminal(os.Stdin) {
+		readStdin = true
 	}
 
-	if expectedHash != "" {
-		actualHash, err := calculateHash(file)
+	if readStdin {
+		stdinNames, err := readExtensionList(os.Stdin)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if actualHash != expectedHash {
-			return fmt.Errorf("Hash for %v does not match (%v != %v)!", name, actualHash, expectedHash)
+		names = append(names, stdinNames...)
+	}
+
+	seen := map[string]struct{}{}
+	unique := []string{}
+	for _, name := range names {
+		name = tce.NormalizeName(name)
+		if _, ok := seen[name]; !ok && name != "" {
+			seen[name] = struct{}{}
+			unique = append(unique, name)
 		}
 	}
 
-	checked[name] = struct{}{}
+	return unique, nil
+}
 
-	dependencies, err := getDependencies(name)
-	if err != nil {
-		return err
+// benchmarkMirrors times how quickly each mirror serves the repository index,
+// and replaces the clients with ones that try the mirrors fastest first. It
+// returns false if every mirror failed.
+func benchmarkMirrors(ctx context.Context, clients []*tce.Client, summary *runSummary) bool {
+	results := clients[0].BenchmarkMirrors(ctx, tce.IndexFile)
+	summary.Bench = results
+
+	ok := false
+	for _, result := range results {
+		ok = ok || result.Error == ""
 	}
 
-	for _, dependency := range dependencies {
-		err = getExtension(dependency)
+	if !ok {
+		return false
+	}
+
+	rankMirrors(clients, results)
+	return true
+}
+
+// probeTimeout is how long -auto-mirror waits for each mirror to answer,
+// short enough not to hold up starting the downloads.
+const probeTimeout = 2 * time.Second
+
+// probeMirrors sends every mirror a quick request for the repository index
+// and reorders them by how soon they answered. Mirrors that fail are only
+// tried last, as they may still serve other files.
+func probeMirrors(ctx context.Context, clients []*tce.Client, summary *runSummary) {
+	results := clients[0].ProbeMirrors(ctx, tce.IndexFile, probeTimeout)
+	summary.Probe = results
+
+	rankMirrors(clients, results)
+}
+
+// rankMirrors replaces the clients with ones that try the mirrors in the
+// order given by the benchmark results.
+func rankMirrors(clients []*tce.Client, results []tce.MirrorBenchmark) {
+	mirrors := clients[0].Options().Mirrors
+
+	names := []string{}
+	for _, result := range results {
+		names = append(names, result.Mirror)
+	}
+
+	logf(tce.LogNormal, "Trying the mirrors in this order: %v\n", strings.Join(tce.RankMirrors(names, results), ", "))
+
+	ranked := tce.RankMirrors(mirrors, results)
+	for i, client := range clients {
+		options := client.Options()
+		options.Mirrors = ranked
+		clients[i] = tce.NewClient(options)
+	}
+}
+
+// expandPatterns replaces each requested name holding any of the glob
+// characters *, ? or [ with the extensions in the repository index that it
+// matches, e.g. firmware-* with every firmware extension.
+func expandPatterns(ctx context.Context, client *tce.Client, extensions []string) ([]string, error) {
+	expanded := []string{}
+	seen := map[string]struct{}{}
+
+	for _, name := range extensions {
+		names := []string{name}
+		if strings.ContainsAny(name, "*?[") {
+			entries, err := client.Search(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(entries) == 0 {
+				return nil, fmt.Errorf("No extensions match %v", name)
+			}
+
+			names = []string{}
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+
+			logf(tce.LogNormal, "Expanded %v to %v extensions.\n", name, len(names))
+		}
+
+		for _, name := range names {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				expanded = append(expanded, name)
+			}
+		}
+	}
+
+	return expanded, nil
+}
+
+// matchCase corrects the case of the requested extension names to that of
+// the repository index.
+func matchCase(ctx context.Context, client *tce.Client, extensions []string) error {
+	for i, name := range extensions {
+		matched, err := client.MatchCase(ctx, name)
 		if err != nil {
 			return err
 		}
+
+		if matched != name {
+			logf(tce.LogNormal, "Using %v for %v.\n", matched, name)
+			extensions[i] = matched
+		}
 	}
 
 	return nil
 }
 
-func main() {
-	flag.Parse()
+// reportUnreachable explains a failure to connect to any mirror at all, which
+// every other file would only repeat, returning false for other errors.
+func reportUnreachable(err error) bool {
+	if !errors.Is(err, tce.ErrUnreachable) {
+		return false
+	}
 
-	if *helpFlag {
-		flag.PrintDefaults()
-		return
+	logf(tce.LogQuiet, "Could not reach any mirror! %v\n", err)
+	logf(tce.LogQuiet, "Check the network connection, or use -offline to work from the files already downloaded.\n")
+	return true
+}
+
+func previewExtension(ctx context.Context, client *tce.Client, name string, listed map[string]struct{}) ([]string, error) {
+	// With -keep-going, what could be resolved is still listed.
+	names, err := client.Resolve(ctx, name)
+	if names == nil {
+		return nil, err
 	}
 
-	n := flag.NArg()
-	if n == 0 {
-		fmt.Printf("USAGE: %v [options] <extension> [extension [...]]\n", os.Args[0])
-		fmt.Printf("Invoke %v -help for more information on available options.\n", os.Args[0])
-		return
+	if *depsOnlyFlag {
+		names = names[1:]
+	}
+
+	previewed := []string{}
+
+	for _, name := range names {
+		if _, ok := listed[name]; ok {
+			continue
+		}
+
+		info, err := os.Stat(client.FilePath(name + ".tcz"))
+		switch {
+		case err == nil && info.Size() > 0:
+			logf(tce.LogQuiet, "%v is already present.\n", name)
+		case err == nil:
+			logf(tce.LogQuiet, "%v is known to be absent.\n", name)
+		case os.IsNotExist(err):
+			logf(tce.LogQuiet, "Would download %v.\n", name)
+		default:
+			return nil, err
+		}
+
+		listed[name] = struct{}{}
+		previewed = append(previewed, name)
+	}
+
+	return previewed, err
+}
+
+func printTree(client *tce.Client, name string, prefix string, shown map[string]struct{}) {
+	dependencies := client.Dependencies(name)
+
+	for i, dependency := range dependencies {
+		branch, indent := "|-- ", "|   "
+		if i == len(dependencies)-1 {
+			branch, indent = "`-- ", "    "
+		}
+
+		if _, ok := shown[dependency]; ok {
+			logf(tce.LogQuiet, "%v%v%v (already shown)\n", prefix, branch, dependency)
+			continue
+		}
+		shown[dependency] = struct{}{}
+
+		logf(tce.LogQuiet, "%v%v%v\n", prefix, branch, dependency)
+		printTree(client, dependency, prefix+indent, shown)
+	}
+}
+
+func dependsOnKernel(client *tce.Client, extension string, kernel string) bool {
+	if strings.Contains(extension, "KERNEL") {
+		return true
+	}
+
+	for _, name := range client.Closure(client.ExpandName(extension)) {
+		if strings.Contains(name, kernel) {
+			return true
+		}
 	}
 
-	baseDir = getBaseDir()
-	fmt.Printf("Base directory: %v\n", baseDir)
+	return false
+}
 
-	os.MkdirAll(baseDir, os.ModeDir|0777)
+func estimateExtensions(ctx context.Context, clients []*tce.Client, previewed [][]string) (tce.SizeEstimate, error) {
+	total := tce.SizeEstimate{Unknown: []string{}}
 
-	for _, extension := range flag.Args() {
-		err := getExtension(extension)
+	for i, client := range clients {
+		estimate, err := client.Estimate(ctx, previewed[i])
 		if err != nil {
-			fmt.Printf("Failed to get %v! %v\n", extension, err.Error())
-		} else {
-			fmt.Printf("Retrieved %v successfully.\n", extension)
+			return total, err
+		}
+
+		total.DownloadFiles += estimate.DownloadFiles
+		total.DownloadBytes += estimate.DownloadBytes
+		total.PresentFiles += estimate.PresentFiles
+		total.PresentBytes += estimate.PresentBytes
+		total.Unknown = append(total.Unknown, estimate.Unknown...)
+	}
+
+	return total, nil
+}
+
+func verifyExtensions(ctx context.Context, client *tce.Client, summary *runSummary) int {
+	results, err := client.Verify(ctx)
+	if err != nil {
+		logf(tce.LogQuiet, "Failed to verify %v! %v\n", summary.BaseDir, err)
+		return 1
+	}
+
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.Status]++
+
+		switch result.Status {
+		case tce.VerifyMismatch:
+			logf(tce.LogQuiet, "%v.tcz: MISMATCH\n", result.Name)
+		case tce.VerifyNoChecksum:
+			logf(tce.LogQuiet, "%v.tcz: NO-CHECKSUM\n", result.Name)
+		case tce.VerifyMissing:
+			logf(tce.LogQuiet, "%v.tcz: MISSING (required by %v)\n", result.Name, strings.Join(result.RequiredBy, ", "))
+		}
+	}
+
+	logf(tce.LogQuiet, "Verified %v extensions: %v OK, %v mismatched, %v without a checksum, %v missing.\n",
+		len(results)-counts[tce.VerifyMissing], counts[tce.VerifyOK], counts[tce.VerifyMismatch],
+		counts[tce.VerifyNoChecksum], counts[tce.VerifyMissing])
+
+	if *jsonFlag {
+		summary.Verified = results
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(summary)
+	}
+
+	if counts[tce.VerifyMismatch] > 0 || *requireChecksumFlag && counts[tce.VerifyNoChecksum] > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func searchIndex(ctx context.Context, client *tce.Client, query string, summary *runSummary) int {
+	entries, err := client.Search(ctx, query)
+	if err != nil {
+		logf(tce.LogQuiet, "Failed to search for %v! %v\n", query, err)
+		return 1
+	}
+
+	summary.Matches = []searchResult{}
+	for _, entry := range entries {
+		result := searchResult{IndexEntry: entry}
+		if *infoFlag {
+			result.Description, err = client.Description(ctx, entry.Name)
+			if err != nil {
+				logf(tce.LogQuiet, "Failed to describe %v! %v\n", entry.Name, err)
+				return 1
+			}
+		}
+
+		summary.Matches = append(summary.Matches, result)
+	}
+
+	for _, result := range summary.Matches {
+		message := result.Name
+		if result.Size >= 0 {
+			message += fmt.Sprintf(" (%v)", tce.FormatSize(result.Size))
+		}
+
+		if result.Description != "" {
+			message += ": " + result.Description
+		}
+
+		logf(tce.LogQuiet, "%v\n", message)
+	}
+
+	logf(tce.LogNormal, "Found %v extensions matching %v.\n", len(entries), query)
+
+	if *jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(summary)
+	}
+
+	return 0
+}
+
+func diffExtensions(ctx context.Context, client *tce.Client, summary *runSummary) int {
+	results, err := client.Diff(ctx)
+	if err != nil {
+		logf(tce.LogQuiet, "Failed to compare %v with the mirror! %v\n", summary.BaseDir, err)
+		return 1
+	}
+
+	width := 0
+	for _, result := range results {
+		if len(result.Name)+4 > width {
+			width = len(result.Name) + 4
+		}
+	}
+
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.Status]++
+		logf(tce.LogQuiet, "%-*v  %v\n", width, result.Name+".tcz", strings.ToUpper(result.Status))
+	}
+
+	logf(tce.LogQuiet, "Compared %v extensions: %v up to date, %v differ, %v gone upstream, %v without a checksum.\n",
+		len(results), counts[tce.DiffUpToDate], counts[tce.DiffDiffers], counts[tce.DiffGone], counts[tce.DiffNoChecksum])
+
+	if *jsonFlag {
+		summary.Diff = results
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(summary)
+	}
+
+	if counts[tce.DiffDiffers] > 0 || counts[tce.DiffGone] > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func pruneExtensions(ctx context.Context, client *tce.Client, extensions []string) int {
+	if len(extensions) == 0 {
+		logf(tce.LogQuiet, "No extensions given to keep! Nothing was pruned.\n")
+		return 1
+	}
+
+	keep := []string{}
+	for _, extension := range extensions {
+		names, err := client.Resolve(ctx, extension)
+		if err != nil {
+			logf(tce.LogQuiet, "Failed to resolve %v! %v\n", extension, err)
+			logf(tce.LogQuiet, "Nothing was pruned.\n")
+			return 1
+		}
+
+		keep = append(keep, names...)
+	}
+
+	orphans, err := client.Orphans(keep)
+	if err != nil {
+		logf(tce.LogQuiet, "Failed to list %v! %v\n", client.Options().BaseDir, err)
+		return 1
+	}
+
+	for _, name := range orphans {
+		if *dryRunFlag {
+			logf(tce.LogQuiet, "Would delete %v.\n", name)
+			continue
+		}
+
+		err = client.RemoveExtension(name)
+		if err != nil {
+			logf(tce.LogQuiet, "Failed to delete %v! %v\n", name, err)
+			return 1
 		}
+
+		logf(tce.LogQuiet, "Deleted %v.\n", name)
+	}
+
+	return 0
+}
+
+func cleanMarkers(client *tce.Client) int {
+	markers, err := client.Markers()
+	if err != nil {
+		logf(tce.LogQuiet, "Failed to list %v! %v\n", client.Options().BaseDir, err)
+		return 1
+	}
+
+	for _, path := range markers {
+		if *dryRunFlag {
+			logf(tce.LogQuiet, "Would delete %v.\n", path)
+			continue
+		}
+
+		err = client.RemoveMarker(path)
+		if err != nil {
+			logf(tce.LogQuiet, "Failed to delete %v! %v\n", path, err)
+			return 1
+		}
+
+		logf(tce.LogVerbose, "Deleted %v.\n", path)
+	}
+
+	if *dryRunFlag {
+		logf(tce.LogQuiet, "Would delete %v absence markers.\n", len(markers))
+	} else {
+		logf(tce.LogQuiet, "Deleted %v absence markers.\n", len(markers))
+	}
+
+	return 0
+}
+
+func printStats(client *tce.Client, summary *runSummary) int {
+	stats, err := client.DirectoryStats()
+	if err != nil {
+		logf(tce.LogQuiet, "Failed to list %v! %v\n", summary.BaseDir, err)
+		return 1
+	}
+
+	logf(tce.LogQuiet, "%v extensions (%v), %v absence markers, %v without a checksum.\n",
+		stats.Extensions, tce.FormatSize(stats.Bytes), stats.Markers, len(stats.WithoutChecksum))
+	if len(stats.WithoutChecksum) > 0 {
+		logf(tce.LogNormal, "Without a checksum: %v\n", strings.Join(stats.WithoutChecksum, ", "))
+	}
+
+	if *jsonFlag {
+		summary.Stats = &stats
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(summary)
+	}
+
+	return 0
+}
+
+func summarizeExtension(name string, result tce.Result, err error) extensionSummary {
+	summary := extensionSummary{
+		Name:         name,
+		Status:       "ok",
+		Dependencies: result.Dependencies,
+		Downloaded:   []string{},
+		Present:      []string{},
+		Files:        result.Files,
+	}
+
+	if err != nil {
+		summary.Status = "failed"
+		summary.Error = err.Error()
+	}
+
+	for _, file := range result.Files {
+		switch file.Status {
+		case "downloaded":
+			summary.Downloaded = append(summary.Downloaded, file.FileName)
+		case "present":
+			summary.Present = append(summary.Present, file.FileName)
+		}
+	}
+
+	return summary
+}
+
+// readPins reads the checksums pinned in the file given with -locked, which
+// must be for the same version and architecture, and for the algorithm chosen
+// with -hash unless it is auto.
+func readPins(path string, options tce.Options) (map[string]string, error) {
+	manifest, err := tce.ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Version != options.Version || manifest.Arch != options.Arch {
+		return nil, fmt.Errorf("%v is for %v/%v, not %v/%v", path, manifest.Version, manifest.Arch, options.Version, options.Arch)
+	}
+
+	pins := map[string]string{}
+	for _, entry := range manifest.Extensions {
+		if options.Hash.Name != tce.AutoHash.Name && entry.Algorithm != options.Hash.Name {
+			return nil, fmt.Errorf("%v pins a %v checksum for %v, but -hash is %v", path, entry.Algorithm, entry.Name, options.Hash.Name)
+		}
+
+		pins[entry.Name] = entry.Hash
+	}
+
+	return pins, nil
+}
+
+// writeManifest pins every extension retrieved by each client in the file
+// given with -write-lock, in load order, listing extensions shared between
+// kernels once. Where the mirror an extension came from is not known, it is
+// kept from the file being replaced if that pins the same checksum.
+func writeManifest(clients []*tce.Client, retrieved [][]string, options tce.Options) error {
+	manifest := tce.Manifest{Version: options.Version, Arch: options.Arch, Extensions: []tce.ManifestEntry{}}
+	seen := map[string]struct{}{}
+
+	previous := map[string]tce.ManifestEntry{}
+	old, err := tce.ReadManifest(*writeLockFlag)
+	if err == nil {
+		for _, entry := range old.Extensions {
+			previous[entry.Name] = entry
+		}
+	}
+
+	for i, client := range clients {
+		entries, err := client.ManifestEntries(client.LoadOrder(retrieved[i]))
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if _, ok := seen[entry.Name]; ok {
+				continue
+			}
+			seen[entry.Name] = struct{}{}
+
+			known, ok := previous[entry.Name]
+			if entry.Mirror == "" && ok && known.Algorithm == entry.Algorithm && known.Hash == entry.Hash {
+				entry.Mirror, entry.URL = known.Mirror, known.URL
+			}
+
+			manifest.Extensions = append(manifest.Extensions, entry)
+		}
+	}
+
+	return tce.WriteManifest(*writeLockFlag, manifest)
+}
+
+// combineGraphs merges the dependency graphs resolved by each client, keeping
+// the first node seen for extensions shared between kernels.
+func combineGraphs(clients []*tce.Client, requested [][]string) []tce.GraphNode {
+	nodes := []tce.GraphNode{}
+	seen := map[string]struct{}{}
+
+	for i, client := range clients {
+		for _, node := range client.Graph(requested[i]) {
+			if _, ok := seen[node.Name]; !ok {
+				seen[node.Name] = struct{}{}
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	return nodes
+}
+
+// printTally reports how many extensions were requested and how many were
+// touched in total, counting files shared between kernels only once.
+func printTally(clients []*tce.Client, attempted [][]string, requested int) {
+	seen := map[string]struct{}{}
+	downloaded, present := 0, 0
+
+	for i, client := range clients {
+		for _, name := range client.LoadOrder(attempted[i]) {
+			fileName := name + ".tcz"
+			filePath := client.FilePath(fileName)
+			if _, ok := seen[filePath]; ok {
+				continue
+			}
+			seen[filePath] = struct{}{}
+
+			switch client.FileStatus(fileName) {
+			case "downloaded":
+				downloaded++
+			case "present":
+				present++
+			}
+		}
+	}
+
+	logf(tce.LogNormal, "Requested %v extensions, %v in total: %v downloaded, %v already present.\n",
+		requested, len(seen), downloaded, present)
+}
+
+// summarizeShared reports how much the requested extensions have in common:
+// how many dependencies they need in total, against the sum of what each needs
+// on its own, and which dependencies the most of them need. An extension
+// requested for several kernels counts once, needing the dependencies of
+// every kernel.
+func summarizeShared(clients []*tce.Client, attempted [][]string) *sharedSummary {
+	shared := &sharedSummary{MostShared: []sharedDependency{}}
+
+	needs := map[string]map[string]struct{}{}
+	for i, client := range clients {
+		for _, root := range attempted[i] {
+			if needs[root] == nil {
+				needs[root] = map[string]struct{}{}
+			}
+
+			for _, name := range client.Closure(client.ExpandName(root)) {
+				needs[root][name] = struct{}{}
+			}
+		}
+	}
+
+	if len(needs) < 2 {
+		return nil
+	}
+
+	counts := map[string]int{}
+	for _, dependencies := range needs {
+		for name := range dependencies {
+			counts[name]++
+			shared.Separate++
+		}
+	}
+
+	shared.Unique = len(counts)
+	for name, count := range counts {
+		if count > 1 {
+			shared.MostShared = append(shared.MostShared, sharedDependency{name, count})
+		}
+	}
+
+	sort.Slice(shared.MostShared, func(i, j int) bool {
+		a, b := shared.MostShared[i], shared.MostShared[j]
+		return a.Count > b.Count || a.Count == b.Count && a.Name < b.Name
+	})
+
+	logf(tce.LogNormal, "Together the requested extensions need %v dependencies; one by one they would need %v.\n",
+		shared.Unique, shared.Separate)
+
+	if len(shared.MostShared) > 0 {
+		listed := []string{}
+		for i, dependency := range shared.MostShared {
+			if i == maxMostShared {
+				break
+			}
+
+			listed = append(listed, fmt.Sprintf("%v (%v)", dependency.Name, dependency.Count))
+		}
+
+		logf(tce.LogNormal, "Most shared: %v\n", strings.Join(listed, ", "))
+	}
+
+	return shared
+}
+
+func summarizeTransfers(clients []*tce.Client) tce.TransferStats {
+	transfers := []tce.Transfer{}
+	for _, client := range clients {
+		transfers = append(transfers, client.Transfers()...)
+	}
+
+	stats := tce.SummarizeTransfers(transfers)
+	if stats.Files > 0 {
+		logf(tce.LogNormal, "Transferred %v in %v files in %v: %v/s on average, %v/s at peak.\n",
+			tce.FormatSize(stats.Bytes), stats.Files, stats.Duration.Round(time.Millisecond),
+			tce.FormatSize(int64(stats.AverageRate)), tce.FormatSize(int64(stats.PeakRate)))
+	}
+
+	return stats
+}
+
+func main() {
+	cmd := parseCommand()
+
+	if *helpFlag {
+		cmd.printUsage()
+		if cmd.name == legacyCommand.name {
+			printCommands()
+		}
+
+		fmt.Println("Options:")
+		flag.PrintDefaults()
+		return
+	}
+
+	// The commands other than download select the modes of the older flags.
+	switch cmd.name {
+	case "verify":
+		*verifyFlag = true
+	case "list":
+		*dryRunFlag = true
+	case "tree":
+		*dryRunFlag, *treeFlag = true, true
+	case "prune":
+		*pruneFlag = true
+	}
+
+	extensions := []string{}
+	if cmd.args == legacyCommand.args && !*verifyFlag {
+		var err error
+		extensions, err = getExtensionNames()
+		if err != nil {
+			fmt.Printf("Failed to read the extension list! %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Pruning against an empty list would delete every extension, so it
+	// always needs one, whatever other work the flags ask for.
+	missing := len(extensions) == 0 && cmd.args == legacyCommand.args && !*verifyFlag && (*pruneFlag || !*updateIndexFlag && !*benchFlag)
+	if cmd.name == "search" {
+		missing = flag.NArg() != 1
+	}
+
+	if missing {
+		cmd.printUsage()
+		if cmd.name == legacyCommand.name {
+			printCommands()
+		}
+
+		fmt.Printf("Invoke %v %v -help for more information on available options.\n", os.Args[0], cmd.name)
+		return
+	}
+
+	options := tce.DefaultOptions()
+	options.Arch = getArch()
+	if !*archAllowUnknownFlag && !isKnownArch(options.Arch) {
+		fmt.Printf("Invalid -arch value! Unknown architecture: %v (expected one of %v)\n", options.Arch, strings.Join(tce.Architectures, ", "))
+		os.Exit(2)
+	}
+	options.Version = *versionFlag
+	options.HTTPS = *httpsFlag
+	options.NoHTTPFallback = *noHttpFallbackFlag
+	options.Retries = *retriesFlag
+	options.RetryDelay = *retryDelayFlag
+	options.RequestTimeout = *requestTimeoutFlag
+	options.UserAgent = *userAgentFlag
+	options.Username = *userFlag
+	options.Password = *passwordFlag
+	options.Jobs = *jobsFlag
+	options.MaxConnsPerHost = *maxConnsPerHostFlag
+	options.NoRepair = *noRepairFlag
+	options.NoMagicCheck = *noMagicCheckFlag
+	options.Force = *forceFlag
+	options.Insecure = *insecureFlag
+	options.MaxDepth = *maxDepthFlag
+	options.DepsOnly = *depsOnlyFlag
+	options.NoDeps = *noDepsFlag
+	options.WithInfo = *withInfoFlag
+	options.WithList = *withListFlag
+	options.RequireChecksum = *requireChecksumFlag
+	// Offline, every missing file is worth knowing about, not just the first.
+	options.KeepGoing = *keepGoingFlag || *offlineFlag
+	options.Update = *updateFlag
+	options.Sync = cmd.name == "update"
+	options.NoAbsentCache = *noAbsentCacheFlag
+	options.AbsentTTL = *absentTtlFlag
+	options.Refresh = *refreshFlag
+	options.IgnoreSpace = *ignoreSpaceFlag
+	dryRun := *dryRunFlag || *estimateFlag
+	options.DryRun = dryRun
+	options.Offline = *offlineFlag
+
+	exclusions, err := getExclusions()
+	if err != nil {
+		fmt.Printf("Invalid -exclude-file value! %v\n", err)
+		os.Exit(2)
+	}
+	options.Exclude = exclusions
+
+	if *maxDepthFlag < 0 {
+		fmt.Printf("Invalid -max-depth value! Depth cannot be negative: %v\n", *maxDepthFlag)
+		os.Exit(2)
+	}
+
+	if *maxConnsPerHostFlag < 0 {
+		fmt.Printf("Invalid -max-conns-per-host value! The limit cannot be negative: %v\n", *maxConnsPerHostFlag)
+		os.Exit(2)
+	}
+
+	if *rateFlag != "" {
+		rate, err := parseSize(*rateFlag)
+		if err != nil {
+			fmt.Printf("Invalid -rate value! %v\n", err)
+			os.Exit(2)
+		}
+
+		options.RateLimit = rate
+	}
+
+	limit, err := parseSize(*confirmSizeFlag)
+	if err != nil {
+		fmt.Printf("Invalid -confirm-size value! %v\n", err)
+		os.Exit(2)
+	}
+
+	// Unattended, the size is only checked when asked for explicitly, as
+	// there is nobody to confirm a large download anyway.
+	if !*yesFlag && (isTerminal(os.Stdin) || flagGiven("confirm-size")) {
+		options.Confirm = confirmDownload(limit)
+	}
+
+	if *proxyFlag != "" {
+		proxy, err := parseProxy(*proxyFlag)
+		if err != nil {
+			fmt.Printf("Invalid -proxy value! %v\n", err)
+			os.Exit(2)
+		}
+
+		options.Proxy = proxy
+	}
+
+	if *caCertFlag != "" {
+		pool, err := loadCACerts(*caCertFlag, !*caCertOnlyFlag)
+		if err != nil {
+			fmt.Printf("Invalid -cacert value! %v\n", err)
+			os.Exit(2)
+		}
+
+		options.RootCAs = pool
+	} else if *caCertOnlyFlag {
+		fmt.Println("The -cacert-only option requires -cacert!")
+		os.Exit(2)
+	}
+
+	options.FileMode, err = parseMode(*modeFlag)
+	if err != nil {
+		fmt.Printf("Invalid -mode value! %v\n", err)
+		os.Exit(2)
+	}
+
+	dirMode, err := parseMode(*dirModeFlag)
+	if err != nil {
+		fmt.Printf("Invalid -dir-mode value! %v\n", err)
+		os.Exit(2)
+	}
+	options.DirMode = dirMode
+
+	var ok bool
+	options.Hash, ok = tce.HashAlgorithms[*hashFlag]
+	if !ok {
+		fmt.Printf("Invalid -hash value! Unknown algorithm: %v\n", *hashFlag)
+		os.Exit(2)
+	}
+
+	if *lockedFlag != "" {
+		options.Pinned, err = readPins(*lockedFlag, options)
+		if err != nil {
+			fmt.Printf("Invalid -locked value! %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	switch {
+	case *quietFlag && *verboseFlag:
+		fmt.Println("The -quiet and -verbose options cannot be combined!")
+		os.Exit(2)
+	case *depsOnlyFlag && *noDepsFlag:
+		fmt.Println("The -deps-only and -no-deps options cannot be combined!")
+		os.Exit(2)
+	case *pruneFlag && (*noDepsFlag || *depsOnlyFlag || *maxDepthFlag > 0 || len(exclusions) > 0):
+		fmt.Println("The -prune option cannot be combined with -no-deps, -deps-only, -max-depth, -exclude or -exclude-file, as every dependency must be kept!")
+		os.Exit(2)
+	case *offlineFlag && (*forceFlag || *updateFlag || *updateIndexFlag || *benchFlag || cmd.name == "update"):
+		fmt.Println("The -offline option cannot be combined with -force, -update, -update-index, -bench or the update command!")
+		os.Exit(2)
+	case *quietFlag:
+		logLevel = tce.LogQuiet
+	case *verboseFlag:
+		logLevel = tce.LogVerbose
+	}
+
+	options.LogLevel = logLevel
+	options.Progress = *jobsFlag <= 1 && !*jsonFlag && logLevel >= tce.LogNormal && isTerminal(os.Stdout)
+
+	options.Mirrors = getMirrors()
+	if *jsonFlag {
+		output = io.Discard
+		options.Output = io.Discard
+	}
+
+	kernels := listFlag{}
+	kernels.Set(*kernelFlag)
+	if len(kernels) == 0 {
+		if kernel, err := detectKernel(); err == nil {
+			kernels = append(kernels, kernel)
+			logf(tce.LogNormal, "Warning: -kernel not given, using the running kernel %v.\n", kernel)
+		} else {
+			kernels = append(kernels, options.Kernel)
+			logf(tce.LogNormal, "Warning: -kernel not given and the running kernel could not be detected, using %v.\n", options.Kernel)
+		}
+	}
+
+	if len(kernels) > 1 && (*verifyFlag || *pruneFlag || cmd.name == "clean" || cmd.name == "stats" || cmd.name == "diff") {
+		fmt.Println("The verify, diff, prune, clean and stats commands cannot be combined with several kernels!")
+		os.Exit(2)
+	}
+
+	options.BaseDir = getBaseDir(options.Arch, "")
+	logf(tce.LogNormal, "Base directory: %v\n", options.BaseDir)
+
+	if options.Insecure {
+		logf(tce.LogQuiet, "WARNING: -insecure disables TLS certificate verification! Downloads over HTTPS are not protected against tampering.\n")
+	}
+
+	if !dryRun || *updateIndexFlag {
+		err := makeDirectory(options.BaseDir, dirMode)
+		if err != nil {
+			fmt.Printf("Failed to create %v! %v\n", options.BaseDir, err)
+			os.Exit(1)
+		}
+	}
+
+	// Lock the base directory before the clients load its state, and make
+	// sure every exit from here on releases the lock.
+	unlock := func() {}
+	if (!dryRun || *updateIndexFlag) && !*noLockFlag {
+		var err error
+		unlock, err = tce.LockDirectory(options.BaseDir)
+		if errors.Is(err, tce.ErrLocked) {
+			fmt.Printf("%v is in use by another run! If it is not, remove %v or use -no-lock.\n", options.BaseDir, filepath.Join(options.BaseDir, tce.LockFile))
+			os.Exit(1)
+		}
+
+		if err != nil {
+			fmt.Printf("Failed to lock %v! %v\n", options.BaseDir, err)
+			os.Exit(1)
+		}
+	}
+	defer unlock()
+
+	exit := func(status int) {
+		unlock()
+		os.Exit(status)
+	}
+
+	clients := make([]*tce.Client, len(kernels))
+	for i, kernel := range kernels {
+		options.Kernel = kernel
+		options.KernelBaseDir = getBaseDir(options.Arch, kernel)
+		clients[i] = tce.NewClient(options)
+
+		if options.KernelBaseDir != options.BaseDir {
+			logf(tce.LogNormal, "Kernel directory for %v: %v\n", kernel, options.KernelBaseDir)
+		}
+
+		if !dryRun {
+			err := makeDirectory(options.KernelBaseDir, dirMode)
+			if err != nil {
+				fmt.Printf("Failed to create %v! %v\n", options.KernelBaseDir, err)
+				exit(1)
+			}
+		}
+	}
+
+	if cmd.name != legacyCommand.name && clients[0].Listed(context.Background(), cmd.name) {
+		logf(tce.LogQuiet, "Warning: %v is also an extension! Running the %v command; use %v download %v to get the extension.\n", cmd.name, cmd.name, os.Args[0], cmd.name)
+	}
+
+	listed := map[string]struct{}{}
+	previewed := make([][]string, len(clients))
+	retrieved := make([][]string, len(clients))
+	attempted := make([][]string, len(clients))
+	requested := make([][]string, len(clients))
+	failed := []string{}
+	exitStatus := 0
+	failure, success, failures := "Failed to get %v! %v\n", "Retrieved %v successfully.\n", "Failed to get %v of %v extensions:\n"
+	if dryRun {
+		failure, success, failures = "Failed to resolve %v! %v\n", "Resolved %v successfully.\n", "Failed to resolve %v of %v extensions:\n"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if *timeoutFlag > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeoutFlag)
+		defer cancel()
+	}
+
+	summary := runSummary{BaseDir: options.BaseDir}
+
+	if *updateIndexFlag {
+		err := clients[0].UpdateIndex(ctx)
+		if reportUnreachable(err) {
+			exit(1)
+		}
+
+		if err != nil {
+			logf(tce.LogQuiet, "Failed to update the index! %v\n", err)
+			exit(1)
+		}
+	}
+
+	if *benchFlag {
+		if !benchmarkMirrors(ctx, clients, &summary) {
+			logf(tce.LogQuiet, "Failed to benchmark the mirrors! None of them served %v.\n", tce.IndexFile)
+			exit(1)
+		}
+	} else if *autoMirrorFlag && len(options.Mirrors) > 1 && !*offlineFlag {
+		probeMirrors(ctx, clients, &summary)
+	}
+
+	extensions, err = expandPatterns(ctx, clients[0], extensions)
+	if reportUnreachable(err) {
+		exit(1)
+	}
+
+	if err != nil {
+		logf(tce.LogQuiet, "Failed to expand the extension patterns! %v\n", err)
+		exit(1)
+	}
+
+	if *ignoreCaseFlag {
+		err := matchCase(ctx, clients[0], extensions)
+		if reportUnreachable(err) {
+			exit(1)
+		}
+
+		if err != nil {
+			logf(tce.LogQuiet, "Failed to match the case of extension names! %v\n", err)
+			exit(1)
+		}
+	}
+
+	if *verifyFlag {
+		exit(verifyExtensions(ctx, clients[0], &summary))
+	}
+
+	if cmd.name == "search" {
+		exit(searchIndex(ctx, clients[0], flag.Arg(0), &summary))
+	}
+
+	if cmd.name == "clean" {
+		exit(cleanMarkers(clients[0]))
+	}
+
+	if cmd.name == "stats" {
+		exit(printStats(clients[0], &summary))
+	}
+
+	if cmd.name == "diff" {
+		exit(diffExtensions(ctx, clients[0], &summary))
+	}
+
+	if *pruneFlag {
+		exit(pruneExtensions(ctx, clients[0], extensions))
+	}
+
+	for i, client := range clients {
+		for _, extension := range extensions {
+			if ctx.Err() != nil {
+				break
+			}
+
+			if i > 0 && !dependsOnKernel(clients[0], extension, kernels[0]) {
+				continue
+			}
+
+			requested[i] = append(requested[i], extension)
+
+			var result tce.Result
+			var err error
+			switch {
+			case cmd.name == "tree":
+				_, err = client.Resolve(ctx, extension)
+				result = client.Result(extension)
+			case dryRun:
+				var names []string
+				names, err = previewExtension(ctx, client, extension, listed)
+				previewed[i] = append(previewed[i], names...)
+				result = client.Result(extension)
+			default:
+				result, err = client.Download(ctx, extension)
+			}
+
+			label := extension
+			if len(clients) > 1 && dependsOnKernel(clients[0], extension, kernels[0]) {
+				label = fmt.Sprintf("%v for %v", extension, kernels[i])
+			}
+
+			// With -deps-only, the extension itself is left out of the
+			// tally and the onboot list.
+			roots := []string{extension}
+			if *depsOnlyFlag {
+				roots = client.Dependencies(client.ExpandName(extension))
+			}
+			attempted[i] = append(attempted[i], roots...)
+
+			if reportUnreachable(err) {
+				exit(1)
+			}
+
+			if err != nil {
+				logf(tce.LogQuiet, failure, label, err.Error())
+				failed = append(failed, fmt.Sprintf("%v: %v", label, err))
+			} else {
+				logf(tce.LogQuiet, success, label)
+				retrieved[i] = append(retrieved[i], roots...)
+			}
+
+			if *treeFlag {
+				name := client.ExpandName(extension)
+				logf(tce.LogQuiet, "%v\n", name)
+				printTree(client, name, "", map[string]struct{}{name: {}})
+			}
+
+			extensionSummary := summarizeExtension(extension, result, err)
+			if len(clients) > 1 {
+				extensionSummary.Kernel = kernels[i]
+			}
+
+			summary.Extensions = append(summary.Extensions, extensionSummary)
+		}
+	}
+
+	if *estimateFlag && ctx.Err() == nil {
+		estimate, err := estimateExtensions(ctx, clients, previewed)
+		if err != nil {
+			logf(tce.LogQuiet, "Failed to estimate the download size! %v\n", err)
+			exitStatus = 1
+		} else {
+			logf(tce.LogQuiet, "Would download %v files (%v); %v files (%v) already present.\n",
+				estimate.DownloadFiles, tce.FormatSize(estimate.DownloadBytes),
+				estimate.PresentFiles, tce.FormatSize(estimate.PresentBytes))
+			if len(estimate.Unknown) > 0 {
+				logf(tce.LogQuiet, "Unknown size: %v\n", strings.Join(estimate.Unknown, ", "))
+			}
+
+			summary.Estimate = &estimate
+		}
+	}
+
+	if *onbootFlag != "" && !dryRun {
+		order := []string{}
+		seen := map[string]struct{}{}
+		for i, client := range clients {
+			for _, name := range client.LoadOrder(retrieved[i]) {
+				if _, ok := seen[name]; !ok {
+					seen[name] = struct{}{}
+					order = append(order, name)
+				}
+			}
+		}
+
+		if len(order) > 0 {
+			err := tce.WriteOnboot(*onbootFlag, order)
+			if err != nil {
+				logf(tce.LogQuiet, "Failed to write %v! %v\n", *onbootFlag, err)
+				exitStatus = 1
+			} else {
+				logf(tce.LogNormal, "Wrote %v.\n", *onbootFlag)
+			}
+		}
+	}
+
+	if *tarFlag != "" && !dryRun {
+		paths := []string{}
+		seen := map[string]struct{}{}
+		for i, client := range clients {
+			for _, path := range client.Files(client.LoadOrder(retrieved[i])) {
+				if _, ok := seen[path]; !ok {
+					seen[path] = struct{}{}
+					paths = append(paths, path)
+				}
+			}
+		}
+
+		if len(paths) > 0 {
+			err := tce.WriteTar(*tarFlag, paths)
+			if err != nil {
+				logf(tce.LogQuiet, "Failed to write %v! %v\n", *tarFlag, err)
+				exitStatus = 1
+			} else {
+				logf(tce.LogNormal, "Wrote %v files to %v.\n", len(paths), *tarFlag)
+			}
+		}
+	}
+
+	if *writeLockFlag != "" && !dryRun {
+		err := writeManifest(clients, retrieved, options)
+		if err != nil {
+			logf(tce.LogQuiet, "Failed to write %v! %v\n", *writeLockFlag, err)
+			exitStatus = 1
+		} else {
+			logf(tce.LogNormal, "Wrote %v.\n", *writeLockFlag)
+		}
+	}
+
+	if *dotFlag != "" {
+		err := tce.WriteDot(*dotFlag, combineGraphs(clients, requested))
+		if err != nil {
+			logf(tce.LogQuiet, "Failed to write %v! %v\n", *dotFlag, err)
+			exitStatus = 1
+		} else {
+			logf(tce.LogNormal, "Wrote %v.\n", *dotFlag)
+		}
+	}
+
+	if *graphJsonFlag != "" {
+		err := tce.WriteGraphJSON(*graphJsonFlag, combineGraphs(clients, requested))
+		if err != nil {
+			logf(tce.LogQuiet, "Failed to write %v! %v\n", *graphJsonFlag, err)
+			exitStatus = 1
+		} else {
+			logf(tce.LogNormal, "Wrote %v.\n", *graphJsonFlag)
+		}
+	}
+
+	if !dryRun && ctx.Err() == nil && len(extensions) > 0 {
+		// An extension requested for several kernels is still one request.
+		unique := map[string]struct{}{}
+		for _, names := range requested {
+			for _, name := range names {
+				unique[name] = struct{}{}
+			}
+		}
+
+		printTally(clients, attempted, len(unique))
+	}
+
+	if ctx.Err() == nil {
+		summary.Shared = summarizeShared(clients, attempted)
+	}
+
+	if !dryRun {
+		stats := summarizeTransfers(clients)
+		summary.Transfers = &stats
+	}
+
+	if len(failed) > 0 {
+		logf(tce.LogQuiet, failures, len(failed), len(summary.Extensions))
+		for _, message := range failed {
+			logf(tce.LogQuiet, "  %v\n", message)
+		}
+
+		exitStatus = 1
+	}
+
+	if *jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(summary)
+	}
+
+	if ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logf(tce.LogQuiet, "Timed out after %v!\n", *timeoutFlag)
+		} else {
+			logf(tce.LogQuiet, "Interrupted!\n")
+		}
+
+		stop()
+		exit(1)
+	}
+
+	if exitStatus != 0 {
+		exit(exitStatus)
 	}
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// commonFlags are accepted by every command: they select the repository and
+// output directory and control how mirrors are reached and what is printed.
+var commonFlags = []string{
+	"arch", "arch-allow-unknown", "cacert", "cacert-only", "dir-mode", "hash", "help", "https", "insecure", "json",
+	"kernel", "mirror", "mode", "no-http-fallback", "no-lock", "out", "password", "proxy", "quiet", "request-timeout",
+	"retries", "retry-delay", "timeout", "user", "user-agent", "verbose", "version",
+}
+
+// resolveFlags are accepted by the commands that resolve dependencies.
+var resolveFlags = []string{
+	"absent-ttl", "deps-only", "dot", "exclude", "exclude-file", "force", "from-file", "graph-json",
+	"ignore-case", "max-depth", "no-absent-cache", "no-deps", "update-index",
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	// flags lists the flags the command accepts besides the common ones, or
+	// is nil if it accepts every flag.
+	flags []string
+	// modes lists the flags that select other commands, which the command
+	// does not accept even though it accepts every other flag.
+	modes []string
+}
+
+var commands = []command{
+	{
+		name:    "download",
+		args:    "<extension> [extension [...]]",
+		summary: "Downloads extensions and their dependencies. This is the default.",
+		modes:   []string{"prune", "verify"},
+	},
+	{
+		name:    "update",
+		args:    "<extension> [extension [...]]",
+		summary: "Downloads again only the extensions whose checksum changed on the mirror, and any new dependencies.",
+		modes:   []string{"dry-run", "estimate", "force", "prune", "update", "verify"},
+	},
+	{
+		name:    "verify",
+		summary: "Checks every extension in the output directory against its checksum.",
+		flags:   []string{"jobs", "refresh", "require-checksum"},
+	},
+	{
+		name:    "list",
+		args:    "<extension> [extension [...]]",
+		summary: "Lists what downloading extensions would fetch, without downloading it.",
+		flags:   append([]string{"estimate"}, resolveFlags...),
+	},
+	{
+		name:    "tree",
+		args:    "<extension> [extension [...]]",
+		summary: "Prints the dependency tree of extensions, without downloading them.",
+		flags:   resolveFlags,
+	},
+	{
+		name:    "search",
+		args:    "<query>",
+		summary: "Lists the extensions in the repository whose names match a query.",
+		flags:   []string{"info", "update-index"},
+	},
+	{
+		name:    "prune",
+		args:    "<extension> [extension [...]]",
+		summary: "Deletes extensions in the output directory that the given ones do not depend on.",
+		flags:   []string{"dry-run", "from-file", "ignore-case"},
+	},
+	{
+		name:    "diff",
+		summary: "Compares the extensions in the output directory with the checksums the mirror publishes.",
+		flags:   []string{},
+	},
+	{
+		name:    "stats",
+		summary: "Summarizes the extensions, absence markers and checksums in the output directory.",
+		flags:   []string{},
+	},
+	{
+		name:    "clean",
+		summary: "Deletes the empty files left in the output directory for files the mirror does not have.",
+		flags:   []string{"dry-run"},
+	},
+}
+
+// legacyCommand runs when no command is named, accepting every flag as the
+// tool did before it had commands.
+var legacyCommand = command{name: "download", args: commands[0].args}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+
+	return command{}, false
+}
+
+func (cmd command) accepts(name string) bool {
+	if cmd.flags == nil {
+		for _, mode := range cmd.modes {
+			if name == mode {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	for _, list := range [][]string{commonFlags, cmd.flags} {
+		for _, accepted := range list {
+			if name == accepted {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// flagSet returns a flag set holding the flags the command accepts. The flags
+// share their values with the global ones, so parsing it sets those.
+func (cmd command) flagSet() *flag.FlagSet {
+	set := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		if cmd.accepts(f.Name) {
+			set.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+
+	set.Usage = func() {
+		cmd.printUsage()
+		set.PrintDefaults()
+	}
+
+	return set
+}
+
+func (cmd command) printUsage() {
+	name := cmd.name
+	if name == legacyCommand.name {
+		name = "[" + name + "]"
+	}
+
+	if cmd.args == "" {
+		fmt.Printf("USAGE: %v %v [options]\n", os.Args[0], name)
+	} else {
+		fmt.Printf("USAGE: %v %v [options] %v\n", os.Args[0], name, cmd.args)
+	}
+
+	if cmd.summary != "" {
+		fmt.Println(cmd.summary)
+	}
+}
+
+// fits returns true if args are valid flags and arguments for the command,
+// parsing them into a throwaway flag set so the global flags are untouched.
+func (cmd command) fits(args []string) bool {
+	set := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	set.SetOutput(io.Discard)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !cmd.accepts(f.Name) {
+			return
+		}
+
+		if value, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && value.IsBoolFlag() {
+			set.Bool(f.Name, false, "")
+		} else {
+			set.String(f.Name, "", "")
+		}
+	})
+
+	if set.Parse(args) != nil {
+		return false
+	}
+
+	if set.Lookup("help").Value.String() == "true" {
+		return true
+	}
+
+	switch {
+	case cmd.args == "":
+		return set.NArg() == 0
+	case cmd.name == "search":
+		return set.NArg() == 1
+	default:
+		return set.NArg() > 0
+	}
+}
+
+// parseCommand picks the command named by the first argument, and parses the
+// remaining arguments into the global flag set. It falls back to downloading
+// when the first argument is not a command, or when the remaining arguments
+// do not fit the command, so that an extension sharing its name with a
+// command, e.g. tree, can still be downloaded by name alone.
+func parseCommand() command {
+	cmd, args := legacyCommand, os.Args[1:]
+	if len(args) > 0 {
+		named, ok := findCommand(args[0])
+		if ok && named.fits(args[1:]) {
+			cmd, args = named, args[1:]
+		}
+	}
+
+	flag.CommandLine = cmd.flagSet()
+	flag.CommandLine.Parse(args)
+
+	return cmd
+}
+
+func printCommands() {
+	fmt.Println("Commands:")
+	for _, cmd := range commands {
+		fmt.Printf("  %-10v%v\n", cmd.name, cmd.summary)
+	}
+}
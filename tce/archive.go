@@ -0,0 +1,119 @@
+package tce
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sidecarSuffixes lists the files kept next to an extension's .tcz file.
+var sidecarSuffixes = []string{MD5.Suffix, SHA256.Suffix, ".dep", ".info", ".list"}
+
+// Files returns the paths of the files the client holds for the given
+// extensions: each .tcz file followed by the checksum, dependency, .info and
+// .list files present next to it. Empty markers are left out.
+func (client *Client) Files(names []string) []string {
+	paths := []string{}
+	for _, name := range names {
+		for _, suffix := range append([]string{""}, sidecarSuffixes...) {
+			path := client.FilePath(name + ".tcz" + suffix)
+
+			info, err := client.options.FileSystem.Stat(path)
+			if err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	return paths
+}
+
+// WriteTar writes the given files to a tar archive at path, replacing it
+// atomically. Each file is stored under its path relative to the deepest
+// directory holding all of them, e.g. just foo.tcz for files in one base
+// directory, so that the archive never holds absolute paths or ones that
+// climb out of the directory it is extracted into.
+func WriteTar(path string, paths []string) error {
+	absPaths := []string{}
+	for _, filePath := range paths {
+		absPath, err := filepath.Abs(filePath)
+		if err != nil {
+			return err
+		}
+
+		absPaths = append(absPaths, absPath)
+	}
+
+	root := commonDir(absPaths)
+
+	return writeAtomically(OSFileSystem{}, path, 0644, func(writer io.Writer) error {
+		archive := tar.NewWriter(writer)
+
+		for _, filePath := range absPaths {
+			name, err := filepath.Rel(root, filePath)
+			if err != nil {
+				return err
+			}
+
+			err = addToTar(archive, filePath, filepath.ToSlash(name))
+			if err != nil {
+				return err
+			}
+		}
+
+		return archive.Close()
+	})
+}
+
+// commonDir returns the deepest directory that holds every one of the given
+// absolute file paths.
+func commonDir(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+
+	common := filepath.Dir(paths[0])
+	for _, filePath := range paths[1:] {
+		dir := filepath.Dir(filePath)
+		for common != dir && !strings.HasPrefix(dir, common+string(filepath.Separator)) {
+			parent := filepath.Dir(common)
+			if parent == common {
+				break
+			}
+
+			common = parent
+		}
+	}
+
+	return common
+}
+
+func addToTar(archive *tar.Writer, filePath string, name string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+
+	err = archive.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(archive, file)
+	return err
+}
@@ -0,0 +1,163 @@
+package tce
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MirrorBenchmark describes how quickly a mirror, given with any password
+// hidden, served a file: the time until the response began, and the size and
+// duration of the transfer that followed. Error is set instead if the mirror
+// failed.
+type MirrorBenchmark struct {
+	Mirror   string        `json:"mirror"`
+	Latency  time.Duration `json:"latency"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+	Rate     float64       `json:"rate"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// BenchmarkMirrors downloads a file from each of the client's mirrors in
+// turn, discarding it rather than saving it, and measures how long each took.
+// The results are in the order of Options.Mirrors.
+func (client *Client) BenchmarkMirrors(ctx context.Context, fileName string) []MirrorBenchmark {
+	results := []MirrorBenchmark{}
+	for _, mirror := range client.options.Mirrors {
+		result := client.benchmarkMirror(ctx, mirror, fileName)
+		results = append(results, result)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return results
+}
+
+func (client *Client) benchmarkMirror(ctx context.Context, mirror string, fileName string) MirrorBenchmark {
+	result := MirrorBenchmark{Mirror: redactURL(mirror)}
+
+	line := client.newStatusLine()
+	line.Printf("Benchmarking %v with %v... ", redactURL(mirror), fileName)
+
+	start := time.Now()
+	response, err := client.fetchFromMirror(ctx, line, "GET", mirror, fileName, 0, time.Time{})
+	if err == nil && response.StatusCode == 404 {
+		closeResponse(response)
+		err = fmt.Errorf("Not found: %v", fileName)
+	}
+
+	if err != nil {
+		line.Printf("Failed! %v\n", err)
+		result.Error = err.Error()
+		return result
+	}
+	defer response.Body.Close()
+
+	result.Latency = time.Since(start)
+
+	start = time.Now()
+	result.Bytes, err = io.Copy(io.Discard, response.Body)
+	result.Duration = time.Since(start)
+	if err != nil {
+		line.Printf("Failed! %v\n", err)
+		result.Error = err.Error()
+		return result
+	}
+
+	if result.Duration > 0 {
+		result.Rate = float64(result.Bytes) / result.Duration.Seconds()
+	}
+
+	line.Printf("OK! (%v latency, %v/s)\n", result.Latency.Round(time.Millisecond), FormatSize(int64(result.Rate)))
+	return result
+}
+
+// ProbeMirrors sends a HEAD request for a file to each of the client's
+// mirrors at once, giving each at most timeout to respond, and measures how
+// long they took. Only Latency is set in the results, which are in the order
+// of Options.Mirrors.
+func (client *Client) ProbeMirrors(ctx context.Context, fileName string, timeout time.Duration) []MirrorBenchmark {
+	mirrors := client.options.Mirrors
+	results := make([]MirrorBenchmark, len(mirrors))
+
+	waitGroup := sync.WaitGroup{}
+	for i, mirror := range mirrors {
+		waitGroup.Add(1)
+		go func(i int, mirror string) {
+			defer waitGroup.Done()
+			results[i] = client.probeMirror(ctx, mirror, fileName, timeout)
+		}(i, mirror)
+	}
+	waitGroup.Wait()
+
+	return results
+}
+
+func (client *Client) probeMirror(ctx context.Context, mirror string, fileName string, timeout time.Duration) MirrorBenchmark {
+	result := MirrorBenchmark{Mirror: redactURL(mirror)}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	line := client.newWholeStatusLine()
+	line.Printf("Probing %v... ", redactURL(mirror))
+
+	start := time.Now()
+	response, err := client.fetchFromMirror(ctx, line, "HEAD", mirror, fileName, 0, time.Time{})
+	if err == nil {
+		closeResponse(response)
+		if response.StatusCode == 404 {
+			err = fmt.Errorf("Not found: %v", fileName)
+		}
+	}
+
+	if err != nil {
+		line.Printf("Failed! %v\n", err)
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Latency = time.Since(start)
+	line.Printf("OK! (%v)\n", result.Latency.Round(time.Millisecond))
+	return result
+}
+
+// RankMirrors orders mirrors by the results BenchmarkMirrors returned for
+// them: fastest first, by the total time taken to serve the file, so that
+// latency counts as much as throughput, then those that failed or were not
+// benchmarked, in their original order.
+func RankMirrors(mirrors []string, results []MirrorBenchmark) []string {
+	failed := func(i int) bool {
+		return i >= len(results) || results[i].Error != ""
+	}
+
+	total := func(i int) time.Duration {
+		return results[i].Latency + results[i].Duration
+	}
+
+	order := make([]int, len(mirrors))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		if failed(order[i]) || failed(order[j]) {
+			return !failed(order[i]) && failed(order[j])
+		}
+
+		return total(order[i]) < total(order[j])
+	})
+
+	ranked := make([]string, len(mirrors))
+	for i, j := range order {
+		ranked[i] = mirrors[j]
+	}
+
+	return ranked
+}
@@ -0,0 +1,78 @@
+package tce
+
+import (
+	"fmt"
+	"time"
+)
+
+// circuitThreshold is how many requests in a row must fail before a mirror
+// is skipped, so that one mirror going down in the middle of a long run does
+// not hold up every file that follows.
+const circuitThreshold = 3
+
+// circuitCooldown is how long a mirror is skipped for once it reaches
+// circuitThreshold. After that, a single request is let through to find out
+// whether it has recovered.
+const circuitCooldown = 30 * time.Second
+
+// mirrorCircuit tracks the consecutive failures of one mirror.
+type mirrorCircuit struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+type circuitError struct {
+	failures int
+}
+
+func (err *circuitError) Error() string {
+	return fmt.Sprintf("Skipped after %v failures in a row", err.failures)
+}
+
+// allowMirror returns an error if requests to a mirror are being skipped.
+// Once the cooldown of a failing mirror ends, only the first request to ask
+// is let through, as a probe, until its outcome is recorded.
+func (client *Client) allowMirror(mirror string) error {
+	client.circuitsMutex.Lock()
+	defer client.circuitsMutex.Unlock()
+
+	circuit, ok := client.circuits[mirror]
+	if !ok || circuit.failures < circuitThreshold {
+		return nil
+	}
+
+	if time.Now().Before(circuit.openUntil) || circuit.probing {
+		return &circuitError{circuit.failures}
+	}
+
+	circuit.probing = true
+	return nil
+}
+
+// recordMirror records the outcome of a request to a mirror, returning true
+// if the failure just made it reach circuitThreshold or failed the probe.
+func (client *Client) recordMirror(mirror string, err error) bool {
+	client.circuitsMutex.Lock()
+	defer client.circuitsMutex.Unlock()
+
+	if err == nil {
+		delete(client.circuits, mirror)
+		return false
+	}
+
+	circuit, ok := client.circuits[mirror]
+	if !ok {
+		circuit = &mirrorCircuit{}
+		client.circuits[mirror] = circuit
+	}
+
+	circuit.failures++
+	circuit.probing = false
+	if circuit.failures < circuitThreshold {
+		return false
+	}
+
+	circuit.openUntil = time.Now().Add(circuitCooldown)
+	return true
+}
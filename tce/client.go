@@ -0,0 +1,577 @@
+// Package tce downloads Tiny Core Linux extensions and their dependencies.
+package tce
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMirror is the mirror used when a Client has no mirrors configured.
+const DefaultMirror = "tinycorelinux.net"
+
+// DefaultUserAgent identifies the downloader to mirrors unless overridden.
+const DefaultUserAgent = "TceDownload/1.0"
+
+const defaultMirrorPath = "/{version}/{arch}/tcz/"
+
+const spaceMargin = 16 << 20
+
+// Architectures lists the architectures for which Tiny Core Linux publishes
+// extensions.
+var Architectures = []string{"x86", "x86_64", "armv6", "armv7", "aarch64"}
+
+// HashAlgorithm describes a checksum algorithm and the suffix of the
+// checksum files published for it.
+type HashAlgorithm struct {
+	Name   string
+	Suffix string
+	New    func() hash.Hash
+}
+
+var (
+	MD5    = HashAlgorithm{"md5", ".md5.txt", md5.New}
+	SHA256 = HashAlgorithm{"sha256", ".sha256.txt", sha256.New}
+
+	// AutoHash uses the strongest algorithm for which each extension has a
+	// published checksum.
+	AutoHash = HashAlgorithm{Name: "auto"}
+)
+
+// HashAlgorithms maps the name of each supported algorithm to it.
+var HashAlgorithms = map[string]HashAlgorithm{
+	MD5.Name:      MD5,
+	SHA256.Name:   SHA256,
+	AutoHash.Name: AutoHash,
+}
+
+// autoHashAlgorithms lists the algorithms AutoHash tries, strongest first.
+var autoHashAlgorithms = []HashAlgorithm{SHA256, MD5}
+
+// LogLevel controls how much a Client prints while it works.
+type LogLevel int
+
+const (
+	LogQuiet LogLevel = iota
+	LogNormal
+	LogVerbose
+)
+
+// Options configures a Client.
+type Options struct {
+	Arch            string
+	Version         string
+	Kernel          string
+	BaseDir         string
+	KernelBaseDir   string
+	Mirrors         []string
+	HTTPS           bool
+	NoHTTPFallback  bool
+	Retries         int
+	RetryDelay      time.Duration
+	RequestTimeout  time.Duration
+	UserAgent       string
+	Username        string
+	Password        string
+	Proxy           *url.URL
+	Insecure        bool
+	RootCAs         *x509.CertPool
+	HTTPClient      *http.Client
+	FileSystem      FileSystem
+	FileMode        os.FileMode
+	DirMode         os.FileMode
+	Jobs            int
+	MaxConnsPerHost int
+	RateLimit       int64
+	Hash            HashAlgorithm
+	Pinned          map[string]string
+	NoRepair        bool
+	NoMagicCheck    bool
+	RequireChecksum bool
+	Force           bool
+	DepsOnly        bool
+	MaxDepth        int
+	Exclude         []string
+	NoDeps          bool
+	WithInfo        bool
+	WithList        bool
+	KeepGoing       bool
+	Update          bool
+	Sync            bool
+	NoAbsentCache   bool
+	AbsentTTL       time.Duration
+	StateFile       string
+	Refresh         bool
+	IgnoreSpace     bool
+	Confirm         func(name string, estimate SizeEstimate) bool
+	DryRun          bool
+	Offline         bool
+	Progress        bool
+	LogLevel        LogLevel
+	Output          io.Writer
+	Events          func(Event)
+}
+
+// DefaultOptions returns options for fetching x86 extensions of Tiny Core
+// Linux 8.x from the default mirror.
+func DefaultOptions() Options {
+	return Options{
+		Arch:       "x86",
+		Version:    "8.x",
+		Kernel:     "4.8.17-tinycore",
+		BaseDir:    "tce/8.x/x86",
+		Mirrors:    []string{DefaultMirror},
+		HTTPS:      true,
+		Retries:    3,
+		RetryDelay: 500 * time.Millisecond,
+		UserAgent:  DefaultUserAgent,
+		Jobs:       1,
+		Hash:       MD5,
+		StateFile:  ".tce-state.json",
+		FileMode:   0644,
+		DirMode:    0755,
+		LogLevel:   LogNormal,
+		Output:     os.Stdout,
+	}
+}
+
+// Client downloads extensions into one base directory. Each Client keeps its
+// own record of what it has fetched, so several can run side by side.
+type Client struct {
+	options         Options
+	httpClient      *http.Client
+	limiter         *rateLimiter
+	checked         map[string]string
+	checkedMutex    sync.Mutex
+	excluded        map[string]struct{}
+	dependencyGraph map[string][]string
+	graphMutex      sync.Mutex
+	fetches         flightGroup
+	fileLocks       map[string]*sync.Mutex
+	fileLocksMutex  sync.Mutex
+	fileStatus      map[string]string
+	fileSources     map[string]fileSource
+	fileStatusMutex sync.Mutex
+	state           map[string]fileState
+	stateChanged    bool
+	stateMutex      sync.Mutex
+	index           map[string]int64
+	indexMutex      sync.Mutex
+	transfers       []Transfer
+	transfersMutex  sync.Mutex
+	circuits        map[string]*mirrorCircuit
+	circuitsMutex   sync.Mutex
+	outputMutex     sync.Mutex
+	eventsMutex     sync.Mutex
+}
+
+// NewClient returns a Client configured with a copy of the given options.
+func NewClient(options Options) *Client {
+	options.Mirrors = append([]string{}, options.Mirrors...)
+	options.Exclude = append([]string{}, options.Exclude...)
+	if len(options.Mirrors) == 0 {
+		options.Mirrors = []string{DefaultMirror}
+	}
+
+	if options.Jobs < 1 {
+		options.Jobs = 1
+	}
+
+	if options.Hash.Name == "" {
+		options.Hash = MD5
+	}
+
+	if options.Output == nil {
+		options.Output = io.Discard
+	}
+
+	if options.FileSystem == nil {
+		options.FileSystem = OSFileSystem{}
+	}
+
+	if options.FileMode == 0 {
+		options.FileMode = 0644
+	}
+
+	if options.DirMode == 0 {
+		options.DirMode = 0755
+	}
+
+	client := &Client{
+		options:         options,
+		httpClient:      options.HTTPClient,
+		checked:         map[string]string{},
+		excluded:        map[string]struct{}{},
+		dependencyGraph: map[string][]string{},
+		fileStatus:      map[string]string{},
+		fileSources:     map[string]fileSource{},
+		fileLocks:       map[string]*sync.Mutex{},
+		state:           map[string]fileState{},
+		circuits:        map[string]*mirrorCircuit{},
+	}
+
+	// A caller-supplied HTTP client, e.g. one pointed at an httptest.Server,
+	// is used as is, so Proxy, RequestTimeout and the limit on redirects do
+	// not apply to it.
+	if client.httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+		if options.Jobs > transport.MaxIdleConnsPerHost {
+			transport.MaxIdleConnsPerHost = options.Jobs
+		}
+
+		// Requests beyond the limit wait for a connection to the same host
+		// to become free.
+		transport.MaxConnsPerHost = options.MaxConnsPerHost
+
+		if options.Proxy != nil {
+			transport.Proxy = http.ProxyURL(options.Proxy)
+		}
+
+		if options.Insecure || options.RootCAs != nil {
+			transport.TLSClientConfig = &tls.Config{
+				InsecureSkipVerify: options.Insecure,
+				RootCAs:            options.RootCAs,
+			}
+		}
+
+		client.httpClient = &http.Client{
+			Transport:     transport,
+			Timeout:       options.RequestTimeout,
+			CheckRedirect: checkRedirect,
+		}
+	}
+
+	if options.RateLimit > 0 {
+		client.limiter = &rateLimiter{rate: options.RateLimit}
+	}
+
+	for _, name := range options.Exclude {
+		client.excluded[client.ExpandName(NormalizeName(name))] = struct{}{}
+	}
+
+	client.loadState()
+	return client
+}
+
+// Options returns the options the client was created with.
+func (client *Client) Options() Options {
+	return client.options
+}
+
+// NormalizeName turns an extension name as a user might type it, e.g.
+// " firefox.tcz", into the name used by the repository.
+func NormalizeName(name string) string {
+	return strings.TrimSuffix(strings.TrimSpace(name), ".tcz")
+}
+
+// ExpandName substitutes the client's kernel for the KERNEL token in an
+// extension name.
+func (client *Client) ExpandName(name string) string {
+	return strings.Replace(name, "KERNEL", client.options.Kernel, -1)
+}
+
+// FilePath returns the local path of a file: in the kernel base directory if
+// its name contains the kernel and one is set, or in the base directory.
+func (client *Client) FilePath(fileName string) string {
+	if client.isKernelFile(fileName) {
+		return filepath.Join(client.options.KernelBaseDir, fileName)
+	}
+
+	return filepath.Join(client.options.BaseDir, fileName)
+}
+
+func (client *Client) isKernelFile(fileName string) bool {
+	return client.options.KernelBaseDir != "" && client.options.Kernel != "" && strings.Contains(fileName, client.options.Kernel)
+}
+
+func (client *Client) directories() []string {
+	if client.options.KernelBaseDir == "" || filepath.Clean(client.options.KernelBaseDir) == filepath.Clean(client.options.BaseDir) {
+		return []string{client.options.BaseDir}
+	}
+
+	return []string{client.options.BaseDir, client.options.KernelBaseDir}
+}
+
+// FileStatus reports whether a file was "downloaded", already "present" or
+// "absent" upstream, or "" if the client has not opened it.
+func (client *Client) FileStatus(fileName string) string {
+	client.fileStatusMutex.Lock()
+	defer client.fileStatusMutex.Unlock()
+
+	return client.fileStatus[fileName]
+}
+
+func (client *Client) setFileStatus(fileName string, status string) {
+	client.fileStatusMutex.Lock()
+	client.fileStatus[fileName] = status
+	client.fileStatusMutex.Unlock()
+}
+
+// fileSource records where a file was downloaded from: the mirror, and the
+// URL that finally served it after any redirects, with passwords hidden.
+type fileSource struct {
+	mirror string
+	url    string
+}
+
+// fileSource returns where a file was downloaded from, or empty strings if
+// the client has not downloaded it.
+func (client *Client) fileSource(fileName string) fileSource {
+	client.fileStatusMutex.Lock()
+	defer client.fileStatusMutex.Unlock()
+
+	return client.fileSources[fileName]
+}
+
+func (client *Client) setFileSource(fileName string, mirror string, location string) {
+	client.fileStatusMutex.Lock()
+	client.fileSources[fileName] = fileSource{redactURL(mirror), redactURL(location)}
+	client.fileStatusMutex.Unlock()
+}
+
+// Download resolves an extension's dependencies and downloads and verifies
+// the extension and everything it depends on. The result describes what was
+// done, even if some of it failed.
+func (client *Client) Download(ctx context.Context, name string) (Result, error) {
+	defer client.saveState()
+
+	name = NormalizeName(name)
+
+	names, resolveErr := client.resolveExtension(ctx, name)
+	if resolveErr != nil && (!client.options.KeepGoing || errors.Is(resolveErr, ErrUnreachable)) {
+		return client.Result(name), resolveErr
+	}
+
+	if client.options.DepsOnly {
+		expanded := client.ExpandName(name)
+		dependencies := []string{}
+		for _, dependency := range names {
+			if dependency != expanded {
+				dependencies = append(dependencies, dependency)
+			}
+		}
+		names = dependencies
+	}
+
+	// Dependencies are fetched before the extensions that need them.
+	names = client.sortNames(names)
+
+	err := client.checkDownload(ctx, name, names)
+	if err != nil {
+		return client.Result(name), err
+	}
+
+	errs := client.fetchExtensions(ctx, names)
+	if resolveErr != nil {
+		var keepGoingErr *keepGoingError
+		if errors.As(resolveErr, &keepGoingErr) {
+			errs = append(keepGoingErr.errs, errs...)
+		} else {
+			errs = append([]error{resolveErr}, errs...)
+		}
+	}
+
+	return client.Result(name), joinErrors(client.ExpandName(name), errs)
+}
+
+// Resolve returns an extension followed by all of its transitive
+// dependencies, reading the .dep files as needed. With KeepGoing, the
+// extensions that could be resolved are returned along with any error.
+func (client *Client) Resolve(ctx context.Context, name string) ([]string, error) {
+	name = NormalizeName(name)
+	_, err := client.resolveExtension(ctx, name)
+	if err != nil && !client.options.KeepGoing {
+		return nil, err
+	}
+
+	name = client.ExpandName(name)
+	return append([]string{name}, client.Closure(name)...), err
+}
+
+// checkDownload estimates what downloading an extension would fetch from the
+// local files and the cached repository index, and fails if it would not fit
+// in the free disk space or if Options.Confirm declines it. Files of unknown
+// size are instead checked against the free space as they are downloaded.
+func (client *Client) checkDownload(ctx context.Context, name string, names []string) error {
+	free, checkSpace := freeSpace(client.options.BaseDir)
+	checkSpace = checkSpace && !client.options.IgnoreSpace
+	if !checkSpace && client.options.Confirm == nil {
+		return nil
+	}
+
+	estimate, err := client.estimate(ctx, names, false)
+	if err != nil {
+		return err
+	}
+
+	if checkSpace && estimate.DownloadBytes > free-spaceMargin {
+		return fmt.Errorf("Not enough disk space: %v needed, %v free", FormatSize(estimate.DownloadBytes), FormatSize(free))
+	}
+
+	pending := estimate.DownloadFiles + len(estimate.Unknown)
+	if client.options.Confirm != nil && pending > 0 && !client.options.Confirm(client.ExpandName(name), estimate) {
+		return fmt.Errorf("Download of %v not confirmed", client.ExpandName(name))
+	}
+
+	return nil
+}
+
+func (client *Client) fetchExtension(ctx context.Context, name string) error {
+	client.checkedMutex.Lock()
+	_, checked := client.checked[name]
+	client.checkedMutex.Unlock()
+
+	if checked {
+		return nil
+	}
+
+	// A pinned checksum replaces the one published by the mirror, so that a
+	// file changed on the mirror is refused rather than accepted.
+	expectedHash, pinned := client.options.Pinned[name]
+	if client.options.Pinned != nil && !pinned {
+		return fmt.Errorf("Extension not pinned: %v", name)
+	}
+
+	var err error
+	if !pinned {
+		expectedHash, err = client.getChecksum(ctx, name, false)
+
+		// Offline, the .tcz file is what most needs adding to the cache, so
+		// it is reported along with its missing checksum.
+		var notCachedErr *notCachedError
+		if errors.As(err, &notCachedErr) {
+			_, statErr := client.options.FileSystem.Stat(client.FilePath(name + ".tcz"))
+			if os.IsNotExist(statErr) {
+				notCachedErr.fileNames = append(notCachedErr.fileNames, name+".tcz")
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if expectedHash == "" && client.options.RequireChecksum {
+		return fmt.Errorf("No checksum published for %v", name)
+	}
+
+	file, err := client.openFile(ctx, name+".tcz", expectedHash)
+
+	var hashErr *hashError
+	if errors.As(err, &hashErr) && !client.options.NoRepair {
+		line := client.newStatusLine()
+		line.Printf("%v Re-downloading %v.\n", err, hashErr.fileName)
+
+		err = client.removeFile(hashErr.fileName)
+		if err != nil {
+			return err
+		}
+
+		file, err = client.openFile(ctx, name+".tcz", expectedHash)
+	}
+
+	if errors.As(err, &hashErr) && pinned {
+		return fmt.Errorf("%v does not match its pinned checksum: %w", name, err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if file == nil {
+		return fmt.Errorf("Extension not found: %v", name)
+	}
+	file.Close()
+
+	// The .info and .list files are optional, so one the mirror does not
+	// have is left as an empty marker like a missing checksum file.
+	sidecars := []string{}
+	if client.options.WithInfo {
+		sidecars = append(sidecars, ".tcz.info")
+	}
+
+	if client.options.WithList {
+		sidecars = append(sidecars, ".tcz.list")
+	}
+
+	for _, suffix := range sidecars {
+		sidecar, err := client.openFile(ctx, name+suffix, "")
+		if err != nil {
+			return err
+		}
+
+		if sidecar != nil {
+			sidecar.Close()
+		}
+	}
+
+	if expectedHash == "" {
+		line := client.newStatusLine()
+		line.Printf("Warning: %v.tcz has no checksum and was not verified.\n", name)
+	}
+
+	client.checkedMutex.Lock()
+	client.checked[name] = expectedHash
+	client.checkedMutex.Unlock()
+
+	return nil
+}
+
+func (client *Client) fetchExtensions(ctx context.Context, names []string) []error {
+	var errs []error
+	var unreachable bool
+	var errMutex sync.Mutex
+	var wait sync.WaitGroup
+
+	queue := make(chan string)
+
+	for i := 0; i < client.options.Jobs; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+
+			for name := range queue {
+				errMutex.Lock()
+				failed := len(errs) > 0 && (!client.options.KeepGoing || ctx.Err() != nil || unreachable)
+				errMutex.Unlock()
+
+				if failed {
+					continue
+				}
+
+				// Concurrent downloads that share a dependency fetch it once.
+				err := client.fetches.do(name, func() error {
+					return client.fetchExtension(ctx, name)
+				})
+				if err != nil {
+					errMutex.Lock()
+					errs = append(errs, err)
+					unreachable = unreachable || errors.Is(err, ErrUnreachable)
+					errMutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, name := range names {
+		queue <- name
+	}
+	close(queue)
+
+	wait.Wait()
+	return errs
+}
@@ -0,0 +1,178 @@
+package tce
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMirror serves files from a map under the default mirror path, failing
+// the first requests for any file listed in failures with a 503.
+type testMirror struct {
+	files    map[string]string
+	failures map[string]int
+	requests map[string]int
+	mutex    sync.Mutex
+}
+
+func (mirror *testMirror) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	fileName := strings.TrimPrefix(request.URL.Path, "/8.x/x86/tcz/")
+
+	mirror.mutex.Lock()
+	mirror.requests[fileName]++
+	failing := mirror.requests[fileName] <= mirror.failures[fileName]
+	mirror.mutex.Unlock()
+
+	if failing {
+		http.Error(writer, "Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	content, ok := mirror.files[fileName]
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+
+	writer.Write([]byte(content))
+}
+
+func md5File(fileName string, content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:]) + "  " + fileName + "\n"
+}
+
+// newTestClient returns a client downloading from handler into a temporary
+// directory, with the options changed by configure if it is not nil.
+func newTestClient(t *testing.T, handler http.Handler, configure func(*Options)) (*Client, string) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	options := DefaultOptions()
+	options.BaseDir = t.TempDir()
+	options.Mirrors = []string{server.URL}
+	options.HTTPClient = server.Client()
+	options.RetryDelay = time.Millisecond
+	options.Output = nil
+	if configure != nil {
+		configure(&options)
+	}
+
+	return NewClient(options), options.BaseDir
+}
+
+func TestDownload(t *testing.T) {
+	a, b := "hsqs a", "hsqs b"
+	mirror := &testMirror{
+		files: map[string]string{
+			"a.tcz.dep":     "b.tcz\n",
+			"a.tcz":         a,
+			"a.tcz.md5.txt": md5File("a.tcz", a),
+			"b.tcz":         b,
+			"b.tcz.md5.txt": md5File("b.tcz", b),
+		},
+		failures: map[string]int{"b.tcz": 2},
+		requests: map[string]int{},
+	}
+
+	client, baseDir := newTestClient(t, mirror, nil)
+	result, err := client.Download(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	if len(result.Dependencies) != 1 || result.Dependencies[0] != "b" {
+		t.Errorf("Dependencies = %v, want [b]", result.Dependencies)
+	}
+
+	for fileName, want := range map[string]string{"a.tcz": a, "b.tcz": b, "b.tcz.dep": ""} {
+		content, err := os.ReadFile(filepath.Join(baseDir, fileName))
+		if err != nil {
+			t.Errorf("Reading %v failed: %v", fileName, err)
+		} else if string(content) != want {
+			t.Errorf("%v = %q, want %q", fileName, content, want)
+		}
+	}
+
+	if got := mirror.requests["b.tcz"]; got != 3 {
+		t.Errorf("b.tcz requested %v times, want 3", got)
+	}
+
+	if got := client.FileStatus("b.tcz.dep"); got != "absent" {
+		t.Errorf("b.tcz.dep status = %q, want absent", got)
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	mirror := &testMirror{
+		files: map[string]string{
+			"a.tcz":         "hsqs a",
+			"a.tcz.md5.txt": md5File("a.tcz", "hsqs other"),
+		},
+		requests: map[string]int{},
+	}
+
+	client, baseDir := newTestClient(t, mirror, func(options *Options) {
+		options.NoRepair = true
+	})
+
+	_, err := client.Download(context.Background(), "a")
+	var hashErr *hashError
+	if !errors.As(err, &hashErr) {
+		t.Fatalf("Download returned %v, want a checksum mismatch", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(baseDir, "a.tcz")); !os.IsNotExist(err) {
+		t.Errorf("a.tcz was kept despite its checksum mismatch")
+	}
+}
+
+func TestDownloadResumeAtWrongOffset(t *testing.T) {
+	content := "hsqs resumed"
+	ranges := 0
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !strings.HasSuffix(request.URL.Path, "/a.tcz") {
+			http.NotFound(writer, request)
+			return
+		}
+
+		// Answer a request for the rest of the file with the whole file.
+		if request.Header.Get("Range") != "" {
+			ranges++
+			writer.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%v/%v", len(content)-1, len(content)))
+			writer.WriteHeader(http.StatusPartialContent)
+		}
+
+		writer.Write([]byte(content))
+	})
+
+	client, baseDir := newTestClient(t, handler, nil)
+	err := os.WriteFile(filepath.Join(baseDir, "a.tcz.part"), []byte("hsqs"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Download(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	read, err := os.ReadFile(filepath.Join(baseDir, "a.tcz"))
+	if err != nil || string(read) != content {
+		t.Errorf("a.tcz = %q, %v, want %q", read, err, content)
+	}
+
+	if ranges != 1 {
+		t.Errorf("Resumed %v times, want 1", ranges)
+	}
+}
@@ -0,0 +1,93 @@
+package tce
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	DiffUpToDate   = "up-to-date"
+	DiffDiffers    = "differs"
+	DiffGone       = "gone"
+	DiffNoChecksum = "no-checksum"
+)
+
+// DiffResult describes how one extension in the base directory compares with
+// the mirror.
+type DiffResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// Diff compares every extension present in the base directories with the
+// checksum the mirror currently publishes for it, which is read afresh without
+// replacing the local checksum file. Extensions the mirror no longer has are
+// reported as gone.
+func (client *Client) Diff(ctx context.Context) ([]DiffResult, error) {
+	names, err := client.presentExtensions()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []DiffResult{}
+	for _, name := range names {
+		status, err := client.diffExtension(ctx, name)
+		if err != nil {
+			return results, err
+		}
+
+		results = append(results, DiffResult{name, status})
+	}
+
+	return results, nil
+}
+
+func (client *Client) diffExtension(ctx context.Context, name string) (string, error) {
+	remoteHash, err := client.getChecksum(ctx, name, true)
+	if err != nil {
+		return "", err
+	}
+
+	line := client.newStatusLine()
+	line.Printf("Comparing %v.tcz... ", name)
+
+	// Without a checksum, all that can be told is whether the mirror still
+	// has the extension at all.
+	if remoteHash == "" {
+		response, _, err := client.fetchFile(ctx, line, "HEAD", name+".tcz", 0, time.Time{})
+		if err != nil {
+			line.Println("Failed!")
+			return "", err
+		}
+		closeResponse(response)
+
+		if response.StatusCode == 404 {
+			line.Println("Gone!")
+			return DiffGone, nil
+		}
+
+		line.Println("No checksum!")
+		return DiffNoChecksum, nil
+	}
+
+	file, err := client.options.FileSystem.Open(client.FilePath(name + ".tcz"))
+	if err != nil {
+		line.Println("Failed!")
+		return "", err
+	}
+	defer file.Close()
+
+	localHash, err := client.calculateHash(file, remoteHash)
+	if err != nil {
+		line.Println("Failed!")
+		return "", err
+	}
+
+	if client.compareHash(line, name+".tcz", localHash, remoteHash) != nil {
+		line.Println("Differs!")
+		return DiffDiffers, nil
+	}
+
+	line.Println("Up to date!")
+	return DiffUpToDate, nil
+}
@@ -0,0 +1,106 @@
+package tce
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// SizeEstimate summarizes how much of a set of extensions is already present
+// and how much remains to be downloaded.
+type SizeEstimate struct {
+	DownloadFiles int      `json:"downloadFiles"`
+	DownloadBytes int64    `json:"downloadBytes"`
+	PresentFiles  int      `json:"presentFiles"`
+	PresentBytes  int64    `json:"presentBytes"`
+	Unknown       []string `json:"unknown"`
+}
+
+// Estimate sizes the .tcz files of the given extensions, using the local copy
+// where there is one, the cached repository index if it lists the size, and a
+// HEAD request otherwise, unless offline. Files whose size cannot be
+// determined are listed as unknown rather than failing the estimate.
+func (client *Client) Estimate(ctx context.Context, names []string) (SizeEstimate, error) {
+	return client.estimate(ctx, names, true)
+}
+
+// estimate is Estimate, only sending HEAD requests if head is set, so that a
+// download can be checked without a request for each file it is about to get.
+func (client *Client) estimate(ctx context.Context, names []string, head bool) (SizeEstimate, error) {
+	estimate := SizeEstimate{Unknown: []string{}}
+
+	index, err := client.loadIndex(ctx, false)
+	if err != nil {
+		return estimate, err
+	}
+
+	for _, name := range names {
+		fileName := name + ".tcz"
+
+		info, err := client.options.FileSystem.Stat(client.FilePath(fileName))
+		if err == nil {
+			if info.Size() > 0 {
+				estimate.PresentFiles++
+				estimate.PresentBytes += info.Size()
+			}
+
+			continue
+		}
+
+		if !os.IsNotExist(err) {
+			return estimate, err
+		}
+
+		if size, ok := index[name]; ok && size >= 0 {
+			estimate.DownloadFiles++
+			estimate.DownloadBytes += size
+			continue
+		}
+
+		if client.options.Offline || !head {
+			estimate.Unknown = append(estimate.Unknown, fileName)
+			continue
+		}
+
+		size, err := client.headFile(ctx, fileName)
+		if ctx.Err() != nil {
+			return estimate, ctx.Err()
+		}
+
+		if err != nil || size < 0 {
+			estimate.Unknown = append(estimate.Unknown, fileName)
+			continue
+		}
+
+		estimate.DownloadFiles++
+		estimate.DownloadBytes += size
+	}
+
+	return estimate, nil
+}
+
+func (client *Client) headFile(ctx context.Context, fileName string) (int64, error) {
+	line := client.newStatusLine()
+	defer line.finish()
+	line.Verbosef("Sizing %v... ", fileName)
+
+	response, _, err := client.fetchFile(ctx, line, "HEAD", fileName, 0, time.Time{})
+	if err != nil {
+		line.Verbosef("Failed!\n")
+		return -1, err
+	}
+	closeResponse(response)
+
+	if response.StatusCode == 404 {
+		line.Verbosef("Not found!\n")
+		return -1, nil
+	}
+
+	if response.ContentLength < 0 {
+		line.Verbosef("Unknown!\n")
+		return -1, nil
+	}
+
+	line.Verbosef("%v\n", FormatSize(response.ContentLength))
+	return response.ContentLength, nil
+}
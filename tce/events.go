@@ -0,0 +1,94 @@
+package tce
+
+import (
+	"time"
+)
+
+// Event is passed to Options.Events as a client works, so that a caller can
+// present progress without parsing the output. It is one of Resolving,
+// Downloading, Verified, Skipped or Failed.
+type Event interface {
+	event()
+}
+
+// Resolving is sent when the client starts reading the dependencies of an
+// extension.
+type Resolving struct {
+	Name string
+}
+
+// Downloading reports the progress of a download: Bytes of Total have been
+// received, including any resumed from a partial file. Total is -1 if the
+// mirror does not send it. It is sent when the transfer starts, every so often
+// while it runs, and once more when it ends.
+type Downloading struct {
+	FileName string
+	Bytes    int64
+	Total    int64
+}
+
+// Verified is sent when a file matches its expected checksum.
+type Verified struct {
+	FileName string
+}
+
+// Skipped is sent when a file is not downloaded, with Reason "present" if the
+// base directory already holds it, or "absent" if the mirror does not have it.
+type Skipped struct {
+	FileName string
+	Reason   string
+}
+
+// Failed is sent when a file could not be checked or downloaded.
+type Failed struct {
+	FileName string
+	Err      error
+}
+
+func (Resolving) event()   {}
+func (Downloading) event() {}
+func (Verified) event()    {}
+func (Skipped) event()     {}
+func (Failed) event()      {}
+
+// emit passes an event to Options.Events, one at a time even when
+// downloading concurrently.
+func (client *Client) emit(event Event) {
+	if client.options.Events == nil {
+		return
+	}
+
+	client.eventsMutex.Lock()
+	client.options.Events(event)
+	client.eventsMutex.Unlock()
+}
+
+// downloadEvents sends Downloading events as the data of a file is written
+// to it, at most every 100ms.
+type downloadEvents struct {
+	client   *Client
+	fileName string
+	bytes    int64
+	total    int64
+	lastSent time.Time
+}
+
+func (client *Client) newDownloadEvents(fileName string, bytes int64, total int64) *downloadEvents {
+	events := &downloadEvents{client: client, fileName: fileName, bytes: bytes, total: total}
+	events.send()
+	return events
+}
+
+func (events *downloadEvents) Write(p []byte) (int, error) {
+	events.bytes += int64(len(p))
+	if time.Since(events.lastSent) >= 100*time.Millisecond {
+		events.send()
+	}
+
+	return len(p), nil
+}
+
+func (events *downloadEvents) send() {
+	events.lastSent = time.Now()
+	events.client.emit(Downloading{events.fileName, events.bytes, events.total})
+}
@@ -0,0 +1,462 @@
+package tce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxDrainSize = 64 << 10
+
+// maxRetryAfter caps how long a Retry-After header can delay a retry.
+const maxRetryAfter = 5 * time.Minute
+
+// maxRedirects caps how many redirects are followed for one request, e.g. from
+// a mirror to a regional CDN.
+const maxRedirects = 5
+
+// ErrUnreachable is wrapped by the error for a file that could not be
+// fetched because no mirror could be connected to at all, e.g. with the
+// network down or a host name that does not resolve, rather than because a
+// mirror answered with an error. KeepGoing stops at such an error, as every
+// other file would fail the same way.
+var ErrUnreachable = errors.New("No mirror could be reached")
+
+// errOffline is returned instead of sending any request with Options.Offline.
+var errOffline = errors.New("Offline")
+
+// errNotModified is returned when a conditional request finds that a file
+// has not changed since the local copy was downloaded.
+var errNotModified = errors.New("Not modified")
+
+type statusError struct {
+	status     string
+	code       int
+	retryAfter time.Duration
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("Server returned: %v", err.status)
+}
+
+type unreachableError struct {
+	err error
+}
+
+func (err *unreachableError) Error() string {
+	return err.err.Error()
+}
+
+func (err *unreachableError) Unwrap() error {
+	return err.err
+}
+
+func (err *unreachableError) Is(target error) bool {
+	return target == ErrUnreachable
+}
+
+// isUnreachable reports whether a request failed before reaching the mirror,
+// looking up its host or connecting to it or to the proxy.
+func isUnreachable(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
+
+// notCachedError lists files missing from the base directory with
+// Options.Offline.
+type notCachedError struct {
+	fileNames []string
+}
+
+func (err *notCachedError) Error() string {
+	return fmt.Sprintf("Not in the cache: %v", strings.Join(err.fileNames, ", "))
+}
+
+type hashError struct {
+	fileName     string
+	actualHash   string
+	expectedHash string
+}
+
+func (err *hashError) Error() string {
+	return fmt.Sprintf("Hash for %v does not match (%v != %v)!", err.fileName, err.actualHash, err.expectedHash)
+}
+
+type lengthError struct {
+	fileName       string
+	actualLength   int64
+	expectedLength int64
+}
+
+func (err *lengthError) Error() string {
+	return fmt.Sprintf("Size of %v does not match (%v != %v bytes)!", err.fileName, err.actualLength, err.expectedLength)
+}
+
+type mirrorError struct {
+	fileName string
+	errs     []error
+}
+
+func (err *mirrorError) Error() string {
+	messages := make([]string, len(err.errs))
+	for i, mirrorErr := range err.errs {
+		messages[i] = mirrorErr.Error()
+	}
+
+	return fmt.Sprintf("All mirrors failed for %v: %v", err.fileName, strings.Join(messages, "; "))
+}
+
+func (err *mirrorError) Unwrap() []error {
+	return err.errs
+}
+
+type keepGoingError struct {
+	name string
+	errs []error
+}
+
+func (err *keepGoingError) Error() string {
+	messages := make([]string, len(err.errs))
+	for i, extensionErr := range err.errs {
+		messages[i] = extensionErr.Error()
+	}
+
+	return fmt.Sprintf("%v failures while getting %v: %v", len(err.errs), err.name, strings.Join(messages, "; "))
+}
+
+func (err *keepGoingError) Unwrap() []error {
+	return err.errs
+}
+
+// joinErrors combines the failures collected under KeepGoing, returning nil
+// if there were none and the error itself if there was only one.
+func joinErrors(name string, errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return &keepGoingError{name, errs}
+	}
+}
+
+func isTransient(err error) bool {
+	var mirrorErr *mirrorError
+	if errors.As(err, &mirrorErr) {
+		for _, err := range mirrorErr.errs {
+			if isTransient(err) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= 500 || statusErr.code == http.StatusTooManyRequests
+	}
+
+	var lengthErr *lengthError
+	if errors.As(err, &lengthErr) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return isConnectionReset(err) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as
+// an HTTP date, returning zero if it is absent or invalid.
+func parseRetryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(header)
+	if err == nil {
+		if seconds < 0 {
+			return 0
+		}
+
+		return time.Duration(seconds) * time.Second
+	}
+
+	date, err := http.ParseTime(header)
+	if err != nil || time.Until(date) < 0 {
+		return 0
+	}
+
+	return time.Until(date)
+}
+
+func (client *Client) getRetryDelay(attempt int, err error) time.Duration {
+	delay := client.options.RetryDelay << uint(attempt-1)
+	if delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay)))
+	} else {
+		delay = 0
+	}
+
+	// A server that asks to be left alone for longer gets its wish, within
+	// reason.
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.retryAfter > delay {
+		delay = statusErr.retryAfter
+		if delay > maxRetryAfter {
+			delay = maxRetryAfter
+		}
+	}
+
+	return delay
+}
+
+func (client *Client) getFileUrls(mirror string, fileName string) (string, string) {
+	scheme, template := "", mirror
+	if i := strings.Index(template, "://"); i >= 0 {
+		scheme, template = template[:i], template[i+3:]
+	}
+
+	template = strings.TrimSuffix(template, "/")
+	if !strings.Contains(template, "/") {
+		template += defaultMirrorPath
+	}
+
+	if !strings.Contains(template, "{file}") {
+		template = strings.TrimSuffix(template, "/") + "/{file}"
+	}
+
+	location := strings.NewReplacer(
+		"%a", client.options.Arch,
+		"%v", client.options.Version,
+		"{arch}", client.options.Arch,
+		"{version}", client.options.Version,
+		"{file}", fileName,
+	).Replace(template)
+
+	switch {
+	case scheme != "":
+		return scheme + "://" + location, ""
+	case !client.options.HTTPS:
+		return "http://" + location, ""
+	case client.options.NoHTTPFallback:
+		return "https://" + location, ""
+	default:
+		return "https://" + location, "http://" + location
+	}
+}
+
+// sendsCredentials reports whether requests for a URL carry a username or
+// password, given in the URL or in the options.
+func (client *Client) sendsCredentials(fileUrl string) bool {
+	if client.options.Username != "" || client.options.Password != "" {
+		return true
+	}
+
+	parsed, err := url.Parse(fileUrl)
+	return err == nil && parsed.User != nil
+}
+
+// redactURL hides the password in a mirror or file URL, with or without a
+// scheme, so that it can be printed.
+func redactURL(location string) string {
+	prefix, rest := "", location
+	if i := strings.Index(rest, "://"); i >= 0 {
+		prefix, rest = rest[:i+3], rest[i+3:]
+	}
+
+	host := rest
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+
+	i := strings.LastIndex(host, "@")
+	if i < 0 {
+		return location
+	}
+
+	userInfo := host[:i]
+	if j := strings.Index(userInfo, ":"); j >= 0 {
+		userInfo = userInfo[:j] + ":xxxxx"
+	}
+
+	return prefix + userInfo + rest[i:]
+}
+
+// checkRedirect stops a chain of redirects that loops back on itself or grows
+// longer than maxRedirects, or that would send credentials over HTTP after
+// HTTPS. Go only drops them on a redirect to another host.
+func checkRedirect(request *http.Request, via []*http.Request) error {
+	previous := via[len(via)-1]
+	if previous.URL.Scheme == "https" && request.URL.Scheme == "http" && request.Header.Get("Authorization") != "" {
+		return fmt.Errorf("Redirect from HTTPS to HTTP at %v (not followed, as it would send the credentials unencrypted)", redactURL(request.URL.String()))
+	}
+
+	for _, previous := range via {
+		if previous.URL.String() == request.URL.String() {
+			return fmt.Errorf("Redirect loop at %v", redactURL(request.URL.String()))
+		}
+	}
+
+	if len(via) > maxRedirects {
+		return fmt.Errorf("Too many redirects (more than %v)", maxRedirects)
+	}
+
+	return nil
+}
+
+func closeResponse(response *http.Response) {
+	io.CopyN(io.Discard, response.Body, maxDrainSize)
+	response.Body.Close()
+}
+
+func (client *Client) httpRequest(ctx context.Context, method string, fileUrl string, offset int64, since time.Time) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, fileUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.options.UserAgent != "" {
+		request.Header.Set("User-Agent", client.options.UserAgent)
+	}
+
+	// Credentials in the mirror URL take precedence over the configured ones.
+	// They are moved to the header so that they never appear in errors.
+	if request.URL.User != nil {
+		password, _ := request.URL.User.Password()
+		request.SetBasicAuth(request.URL.User.Username(), password)
+		request.URL.User = nil
+	} else if client.options.Username != "" || client.options.Password != "" {
+		request.SetBasicAuth(client.options.Username, client.options.Password)
+	}
+
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+	}
+
+	if !since.IsZero() {
+		request.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+	}
+
+	return client.httpClient.Do(request)
+}
+
+func (client *Client) fetchFromMirror(ctx context.Context, line *statusLine, method string, mirror string, fileName string, offset int64, since time.Time) (*http.Response, error) {
+	if client.options.Offline {
+		return nil, errOffline
+	}
+
+	fileUrl, fallbackUrl := client.getFileUrls(mirror, fileName)
+
+	line.Verbosef("[%v %v] ", method, redactURL(fileUrl))
+	response, err := client.httpRequest(ctx, method, fileUrl, offset, since)
+	if err != nil && fallbackUrl != "" && ctx.Err() == nil {
+		// A failed TLS handshake, which anyone on the path can cause, must
+		// not get the credentials sent in the clear.
+		if client.sendsCredentials(fileUrl) {
+			return nil, fmt.Errorf("%w (not falling back to HTTP, which would send the credentials unencrypted)", err)
+		}
+
+		line.Printf("HTTPS failed (%v), falling back to HTTP... ", err)
+		line.Verbosef("[%v %v] ", method, redactURL(fallbackUrl))
+		response, err = client.httpRequest(ctx, method, fallbackUrl, offset, since)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Request.URL.String() != fileUrl && response.Request.URL.String() != fallbackUrl {
+		line.Verbosef("[redirected to %v] ", redactURL(response.Request.URL.String()))
+	}
+
+	if response.StatusCode == 416 && offset > 0 {
+		return response, nil
+	}
+
+	if response.StatusCode == 304 && !since.IsZero() {
+		return response, nil
+	}
+
+	if (response.StatusCode < 200 || response.StatusCode >= 300) && response.StatusCode != 404 {
+		closeResponse(response)
+		return nil, &statusError{response.Status, response.StatusCode, parseRetryAfter(response.Header.Get("Retry-After"))}
+	}
+
+	return response, nil
+}
+
+func (client *Client) fetchFile(ctx context.Context, line *statusLine, method string, fileName string, offset int64, since time.Time) (*http.Response, string, error) {
+	mirrors := client.options.Mirrors
+	errs := []error{}
+
+	for i, mirror := range mirrors {
+		// With a single mirror there is nothing to fall through to, so it is
+		// always tried.
+		if len(mirrors) > 1 {
+			err := client.allowMirror(mirror)
+			if err != nil {
+				line.Verbosef("[skipping %v] ", redactURL(mirror))
+				errs = append(errs, fmt.Errorf("%v: %w", redactURL(mirror), err))
+				continue
+			}
+		}
+
+		response, err := client.fetchFromMirror(ctx, line, method, mirror, fileName, offset, since)
+		if err == nil {
+			client.recordMirror(mirror, nil)
+			return response, mirror, nil
+		}
+
+		if len(mirrors) == 1 && isUnreachable(err) && ctx.Err() == nil {
+			return nil, "", &unreachableError{err}
+		}
+
+		if len(mirrors) == 1 || ctx.Err() != nil {
+			return nil, "", err
+		}
+
+		errs = append(errs, fmt.Errorf("%v: %w", redactURL(mirror), err))
+		if i < len(mirrors)-1 {
+			line.Printf("%v failed (%v), trying %v... ", redactURL(mirror), err, redactURL(mirrors[i+1]))
+		}
+
+		if client.recordMirror(mirror, err) {
+			line.Printf("(skipping %v for %v after %v failures in a row) ", redactURL(mirror), circuitCooldown, circuitThreshold)
+		}
+	}
+
+	// Mirrors skipped after failing before do not count either way.
+	unreachable := false
+	for _, err := range errs {
+		var circuitErr *circuitError
+		if errors.As(err, &circuitErr) {
+			continue
+		}
+
+		unreachable = isUnreachable(err)
+		if !unreachable {
+			break
+		}
+	}
+
+	if unreachable {
+		return nil, "", &unreachableError{&mirrorError{fileName, errs}}
+	}
+
+	return nil, "", &mirrorError{fileName, errs}
+}
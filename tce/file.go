@@ -0,0 +1,633 @@
+package tce
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hashAlgorithm returns the algorithm that produced expectedHash, which with
+// AutoHash is told apart by the length of the digest.
+func (client *Client) hashAlgorithm(expectedHash string) HashAlgorithm {
+	if client.options.Hash.New != nil {
+		return client.options.Hash
+	}
+
+	for _, algorithm := range autoHashAlgorithms {
+		if len(expectedHash) == algorithm.New().Size()*2 {
+			return algorithm
+		}
+	}
+
+	return MD5
+}
+
+func (client *Client) calculateHash(reader io.Reader, expectedHash string) (string, error) {
+	hash := client.hashAlgorithm(expectedHash).New()
+
+	_, err := io.Copy(hash, reader)
+	if err != nil {
+		return "", err
+	}
+
+	raw := hash.Sum(nil)
+	return hex.EncodeToString(raw), nil
+}
+
+func (client *Client) verifyHash(line *statusLine, file File, fileName string, expectedHash string) error {
+	if expectedHash == "" {
+		return nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if client.isVerified(fileName, info, expectedHash) {
+		line.Verbosef("[%v verified previously] ", client.hashAlgorithm(expectedHash).Name)
+		client.emit(Verified{fileName})
+		return nil
+	}
+
+	actualHash, err := client.calculateHash(file, expectedHash)
+	if err != nil {
+		return err
+	}
+
+	err = client.compareHash(line, fileName, actualHash, expectedHash)
+	if err != nil {
+		return err
+	}
+
+	client.recordVerified(fileName, info, actualHash)
+
+	_, err = file.Seek(0, 0)
+	return err
+}
+
+func (client *Client) compareHash(line *statusLine, fileName string, actualHash string, expectedHash string) error {
+	line.Verbosef("[%v %v, expected %v] ", client.hashAlgorithm(expectedHash).Name, actualHash, expectedHash)
+
+	if actualHash != expectedHash {
+		return &hashError{fileName, actualHash, expectedHash}
+	}
+
+	client.emit(Verified{fileName})
+	return nil
+}
+
+func (client *Client) downloadFile(ctx context.Context, line *statusLine, fileName string, filePath string, expectedHash string, since time.Time) (File, string, error) {
+	partPath := filePath + ".part"
+
+	// The base directories may be templated per kernel, so make sure the
+	// directory of each file exists right before writing to it.
+	err := client.options.FileSystem.MkdirAll(filepath.Dir(filePath), client.options.DirMode)
+	if err != nil {
+		return nil, "", err
+	}
+
+	part, err := client.options.FileSystem.OpenFile(partPath, os.O_RDWR|os.O_CREATE, client.options.FileMode)
+	if err != nil {
+		return nil, "", err
+	}
+	defer part.Close()
+
+	offset, err := part.Seek(0, 2)
+	if err != nil {
+		return nil, "", err
+	}
+
+	response, mirror, err := client.fetchFile(ctx, line, "GET", fileName, offset, since)
+	if err != nil {
+		return nil, "", err
+	}
+	defer closeResponse(response)
+
+	switch response.StatusCode {
+	case 404:
+		part.Close()
+		client.options.FileSystem.Remove(partPath)
+
+		if client.options.NoAbsentCache {
+			client.options.FileSystem.Remove(filePath)
+			return nil, mirror, nil
+		}
+
+		file, err := client.options.FileSystem.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, client.options.FileMode)
+		if err != nil {
+			return nil, "", err
+		}
+
+		file.Chmod(client.options.FileMode)
+		file.Close()
+		return nil, mirror, nil
+	case 416:
+		part.Close()
+		client.options.FileSystem.Remove(partPath)
+		return client.downloadFile(ctx, line, fileName, filePath, expectedHash, since)
+	case 304:
+		part.Close()
+		client.options.FileSystem.Remove(partPath)
+		return nil, mirror, errNotModified
+	case 206:
+		// A body that does not continue where the partial download ends
+		// would corrupt it, so start over instead.
+		contentRange := response.Header.Get("Content-Range")
+		if start, ok := contentRangeStart(contentRange); !ok || start != offset {
+			if offset == 0 {
+				return nil, "", fmt.Errorf("Unexpected Content-Range for %v: %v", fileName, contentRange)
+			}
+
+			line.Verbosef("[resumed at %v instead of byte %v, restarting] ", contentRange, offset)
+			closeResponse(response)
+			part.Close()
+			client.options.FileSystem.Remove(partPath)
+			return client.downloadFile(ctx, line, fileName, filePath, expectedHash, since)
+		}
+	default:
+		offset = 0
+		err = part.Truncate(0)
+		if err == nil {
+			_, err = part.Seek(0, 0)
+		}
+
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Files whose size was not known before the download are checked as
+	// soon as the mirror gives their length.
+	if response.ContentLength >= 0 && !client.options.IgnoreSpace {
+		free, ok := freeSpace(filepath.Dir(filePath))
+		if ok && response.ContentLength > free-spaceMargin {
+			return nil, "", fmt.Errorf("Not enough disk space: %v needed, %v free", FormatSize(response.ContentLength), FormatSize(free))
+		}
+	}
+
+	var body io.Reader = response.Body
+	if client.limiter != nil {
+		body = &throttledReader{body, client.limiter}
+	}
+
+	total := int64(-1)
+	if response.ContentLength >= 0 {
+		total = offset + response.ContentLength
+	}
+
+	var progress *progressBar
+	if client.options.Progress {
+		progress = newProgressBar(line, offset, total)
+		body = io.TeeReader(body, progress)
+	}
+
+	var events *downloadEvents
+	if client.options.Events != nil {
+		events = client.newDownloadEvents(fileName, offset, total)
+		body = io.TeeReader(body, events)
+	}
+
+	var writer io.Writer = part
+	var digest hash.Hash
+	if expectedHash != "" {
+		digest = client.hashAlgorithm(expectedHash).New()
+		writer = io.MultiWriter(part, digest)
+
+		if offset > 0 {
+			_, err = part.Seek(0, 0)
+			if err == nil {
+				_, err = io.CopyN(digest, part, offset)
+			}
+
+			if err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	// Only the transfer itself is timed, so that the statistics reflect the
+	// network rather than the local disk.
+	start := time.Now()
+	copied, err := io.Copy(writer, body)
+	elapsed := time.Since(start)
+	if progress != nil {
+		progress.finish()
+	}
+
+	if events != nil {
+		events.send()
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			part.Close()
+			client.options.FileSystem.Remove(partPath)
+			return nil, "", ctx.Err()
+		}
+
+		return nil, "", err
+	}
+
+	client.recordTransfer(fileName, copied, elapsed)
+	line.Verbosef("[%v in %v] ", FormatSize(copied), elapsed)
+
+	if response.ContentLength >= 0 && copied != response.ContentLength {
+		if copied > response.ContentLength {
+			part.Close()
+			client.options.FileSystem.Remove(partPath)
+		}
+
+		return nil, "", &lengthError{fileName, copied, response.ContentLength}
+	}
+
+	if digest != nil {
+		err = client.compareHash(line, fileName, hex.EncodeToString(digest.Sum(nil)), expectedHash)
+		if err != nil {
+			part.Close()
+			client.options.FileSystem.Remove(partPath)
+			return nil, "", err
+		}
+	}
+
+	if strings.HasSuffix(fileName, ".tcz") && !client.options.NoMagicCheck {
+		err = checkMagic(part, fileName)
+		if err != nil {
+			part.Close()
+			client.options.FileSystem.Remove(partPath)
+			return nil, "", err
+		}
+	}
+
+	// The mode is set explicitly, so that it does not depend on the umask.
+	err = part.Chmod(client.options.FileMode)
+	if err == nil {
+		err = part.Sync()
+	}
+
+	if err == nil {
+		err = part.Close()
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Keep the mirror's modification time, so that the file's age reflects
+	// when it last changed upstream rather than when it was downloaded.
+	modTime, err := http.ParseTime(response.Header.Get("Last-Modified"))
+	if err == nil {
+		err = client.options.FileSystem.Chtimes(partPath, modTime, modTime)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	err = client.options.FileSystem.Rename(partPath, filePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	file, err := client.options.FileSystem.Open(filePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	client.setFileSource(fileName, mirror, response.Request.URL.String())
+
+	if digest != nil {
+		info, err := file.Stat()
+		if err == nil {
+			client.recordVerified(fileName, info, expectedHash)
+		}
+	}
+
+	return file, mirror, nil
+}
+
+func (client *Client) isMarkerFresh(info os.FileInfo) bool {
+	if client.options.NoAbsentCache {
+		return false
+	}
+
+	return client.options.AbsentTTL <= 0 || time.Since(info.ModTime()) < client.options.AbsentTTL
+}
+
+// contentRangeStart returns the first byte of a Content-Range header such as
+// "bytes 100-199/200".
+func contentRangeStart(header string) (int64, bool) {
+	span, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, false
+	}
+
+	first, _, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, false
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	return start, err == nil
+}
+
+func checkMagic(file File, fileName string) error {
+	magic := make([]byte, 4)
+
+	_, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if string(magic) != "hsqs" && string(magic) != "sqsh" {
+		return fmt.Errorf("%v is not a squashfs image", fileName)
+	}
+
+	return nil
+}
+
+func writeAtomically(fileSystem FileSystem, path string, mode os.FileMode, write func(io.Writer) error) error {
+	temp, err := fileSystem.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	err = write(temp)
+	if err == nil {
+		err = temp.Chmod(mode)
+	}
+
+	if err == nil {
+		err = temp.Sync()
+	}
+
+	closeErr := temp.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = fileSystem.Rename(temp.Name(), path)
+	}
+
+	if err != nil {
+		fileSystem.Remove(temp.Name())
+	}
+
+	return err
+}
+
+func (client *Client) removeFile(fileName string) error {
+	filePath := client.FilePath(fileName)
+
+	for _, path := range []string{filePath, filePath + ".part"} {
+		err := client.options.FileSystem.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lockFile serializes work on a file, so that concurrent downloads never
+// write the same .part file. It returns the function that unlocks it.
+func (client *Client) lockFile(fileName string) func() {
+	client.fileLocksMutex.Lock()
+	lock, ok := client.fileLocks[fileName]
+	if !ok {
+		lock = &sync.Mutex{}
+		client.fileLocks[fileName] = lock
+	}
+	client.fileLocksMutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+func (client *Client) openFile(ctx context.Context, fileName string, expectedHash string) (io.ReadCloser, error) {
+	file, err := client.checkFile(ctx, fileName, expectedHash)
+	if err != nil {
+		client.emit(Failed{fileName, err})
+	}
+
+	return file, err
+}
+
+func (client *Client) checkFile(ctx context.Context, fileName string, expectedHash string) (io.ReadCloser, error) {
+	unlock := client.lockFile(fileName)
+	defer unlock()
+
+	filePath := client.FilePath(fileName)
+	line := client.newStatusLine()
+
+	// Syncing refreshes the checksum and dependency files, so that an
+	// extension whose checksum changed fails verification and is repaired.
+	refresh := client.options.Force || client.options.Sync && isMetadata(fileName)
+	if refresh && client.FileStatus(fileName) == "" && !client.options.Offline {
+		line.Printf("Downloading %v", fileName)
+		line.Verbosef(" (%v)", filePath)
+		line.Printf("... ")
+		return client.retryDownload(ctx, line, fileName, filePath, expectedHash, time.Time{})
+	}
+
+	if client.options.Update && client.FileStatus(fileName) == "" && !client.options.Offline {
+		info, err := client.options.FileSystem.Stat(filePath)
+		if err == nil && info.Size() > 0 {
+			line.Printf("Updating %v", fileName)
+			line.Verbosef(" (%v)", filePath)
+			line.Printf("... ")
+			return client.retryDownload(ctx, line, fileName, filePath, expectedHash, info.ModTime())
+		}
+	}
+
+	line.Printf("Checking %v", fileName)
+	line.Verbosef(" (%v)", filePath)
+	line.Printf("... ")
+
+	file, err := client.options.FileSystem.Open(filePath)
+	if err == nil {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			line.Println("Failed!")
+			return nil, err
+		}
+
+		if info.Size() > 0 {
+			err = client.verifyHash(line, file, fileName, expectedHash)
+			if err != nil {
+				file.Close()
+				line.Println("Failed!")
+				return nil, err
+			}
+
+			line.Println("Present!")
+			client.setFileStatus(fileName, "present")
+			client.emit(Skipped{fileName, "present"})
+			return file, nil
+		}
+
+		file.Close()
+		if client.isMarkerFresh(info) || client.options.Offline {
+			line.Println("Known absent!")
+			client.setFileStatus(fileName, "absent")
+			client.emit(Skipped{fileName, "absent"})
+			return nil, nil
+		}
+
+		line.Println("Expired!")
+		line.Printf("Downloading %v... ", fileName)
+		return client.retryDownload(ctx, line, fileName, filePath, expectedHash, time.Time{})
+	}
+
+	if !os.IsNotExist(err) {
+		line.Println("Failed!")
+		return nil, err
+	}
+
+	line.Println("Absent!")
+	if client.options.Offline {
+		return nil, &notCachedError{[]string{fileName}}
+	}
+
+	line.Printf("Downloading %v... ", fileName)
+	return client.retryDownload(ctx, line, fileName, filePath, expectedHash, time.Time{})
+}
+
+func isMetadata(fileName string) bool {
+	for _, algorithm := range autoHashAlgorithms {
+		if strings.HasSuffix(fileName, ".tcz"+algorithm.Suffix) {
+			return true
+		}
+	}
+
+	return strings.HasSuffix(fileName, ".tcz.dep")
+}
+
+func (client *Client) retryDownload(ctx context.Context, line *statusLine, fileName string, filePath string, expectedHash string, since time.Time) (io.ReadCloser, error) {
+	for attempt := 1; ; attempt++ {
+		file, mirror, err := client.downloadFile(ctx, line, fileName, filePath, expectedHash, since)
+		if err == errNotModified {
+			file, err = client.options.FileSystem.Open(filePath)
+			if err == nil {
+				err = client.verifyHash(line, file, fileName, expectedHash)
+				if err == nil {
+					line.Println("Not modified!")
+					client.setFileStatus(fileName, "present")
+					client.emit(Skipped{fileName, "present"})
+					return file, nil
+				}
+
+				file.Close()
+			}
+
+			// The local copy cannot be trusted, so fetch it again in full.
+			line.Printf("Failed! %v\n", err)
+			line.Printf("Downloading %v... ", fileName)
+			since = time.Time{}
+			continue
+		}
+
+		if err == nil {
+			if file == nil {
+				line.Println("OK!")
+				client.setFileStatus(fileName, "absent")
+				client.emit(Skipped{fileName, "absent"})
+				return nil, nil
+			}
+
+			client.setFileStatus(fileName, "downloaded")
+
+			if len(client.options.Mirrors) > 1 {
+				line.Printf("OK! (%v)\n", redactURL(mirror))
+			} else {
+				line.Println("OK!")
+			}
+			return file, nil
+		}
+
+		if !isTransient(err) || attempt > client.options.Retries || ctx.Err() != nil {
+			line.Println("Failed!")
+			return nil, err
+		}
+
+		delay := client.getRetryDelay(attempt, err)
+		line.Printf("Failed! %v\n", err)
+		line.Printf("Retrying %v in %v (attempt %v of %v)... ", fileName, delay.Round(time.Millisecond), attempt+1, client.options.Retries+1)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			line.Println("Failed!")
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (client *Client) peekFile(ctx context.Context, fileName string) (io.ReadCloser, error) {
+	filePath := client.FilePath(fileName)
+	line := client.newStatusLine()
+
+	line.Printf("Checking %v", fileName)
+	line.Verbosef(" (%v)", filePath)
+	line.Printf("... ")
+
+	info, err := client.options.FileSystem.Stat(filePath)
+	if err == nil && client.options.Force {
+		err = os.ErrNotExist
+	}
+
+	if err == nil && info.Size() > 0 {
+		line.Println("Present!")
+		return client.options.FileSystem.Open(filePath)
+	}
+
+	if err == nil && (client.isMarkerFresh(info) || client.options.Offline) {
+		line.Println("Known absent!")
+		return nil, nil
+	}
+
+	if err == nil {
+		line.Println("Expired!")
+	} else if os.IsNotExist(err) {
+		line.Println("Absent!")
+	} else {
+		line.Println("Failed!")
+		return nil, err
+	}
+
+	if client.options.Offline {
+		return nil, &notCachedError{[]string{fileName}}
+	}
+
+	line.Printf("Reading %v... ", fileName)
+	return client.readRemoteFile(ctx, line, fileName)
+}
+
+// readRemoteFile reads a file from the mirror without saving it, returning
+// nil if the mirror does not have it.
+func (client *Client) readRemoteFile(ctx context.Context, line *statusLine, fileName string) (io.ReadCloser, error) {
+	response, _, err := client.fetchFile(ctx, line, "GET", fileName, 0, time.Time{})
+	if err != nil {
+		line.Println("Failed!")
+		return nil, err
+	}
+
+	if response.StatusCode == 404 {
+		closeResponse(response)
+		line.Println("Not found!")
+		return nil, nil
+	}
+
+	line.Println("OK!")
+	return response.Body, nil
+}
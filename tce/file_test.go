@@ -0,0 +1,58 @@
+package tce
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCheckFile(t *testing.T) {
+	content := "hsqs a"
+	sum := md5.Sum([]byte(content))
+
+	fileSystem := newMemFileSystem()
+	fileSystem.add("tce/a.tcz", content, time.Now())
+	fileSystem.add("tce/b.tcz", "", time.Now())
+
+	options := DefaultOptions()
+	options.BaseDir = "tce"
+	options.FileSystem = fileSystem
+	options.Offline = true
+	options.Output = nil
+	client := NewClient(options)
+	ctx := context.Background()
+
+	file, err := client.checkFile(ctx, "a.tcz", hex.EncodeToString(sum[:]))
+	if err != nil || file == nil {
+		t.Fatalf("checkFile(a.tcz) = %v, %v, want the present file", file, err)
+	}
+
+	read, err := io.ReadAll(file)
+	file.Close()
+	if err != nil || string(read) != content {
+		t.Errorf("Reading a.tcz = %q, %v, want %q", read, err, content)
+	}
+
+	if got := client.FileStatus("a.tcz"); got != "present" {
+		t.Errorf("a.tcz status = %q, want present", got)
+	}
+
+	file, err = client.checkFile(ctx, "b.tcz", "")
+	if err != nil || file != nil {
+		t.Fatalf("checkFile(b.tcz) = %v, %v, want nothing for a known-absent file", file, err)
+	}
+
+	if got := client.FileStatus("b.tcz"); got != "absent" {
+		t.Errorf("b.tcz status = %q, want absent", got)
+	}
+
+	_, err = client.checkFile(ctx, "c.tcz", "")
+	var notCachedErr *notCachedError
+	if !errors.As(err, &notCachedErr) {
+		t.Errorf("checkFile(c.tcz) returned %v, want a missing file offline to be reported", err)
+	}
+}
@@ -0,0 +1,41 @@
+package tce
+
+import "sync"
+
+// flightGroup collapses concurrent calls with the same key into a single
+// call whose result is shared, like golang.org/x/sync/singleflight.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	err  error
+}
+
+func (group *flightGroup) do(key string, fn func() error) error {
+	group.mutex.Lock()
+	if group.calls == nil {
+		group.calls = map[string]*flightCall{}
+	}
+
+	if call, ok := group.calls[key]; ok {
+		group.mutex.Unlock()
+		<-call.done
+		return call.err
+	}
+
+	call := &flightCall{done: make(chan struct{})}
+	group.calls[key] = call
+	group.mutex.Unlock()
+
+	call.err = fn()
+	close(call.done)
+
+	group.mutex.Lock()
+	delete(group.calls, key)
+	group.mutex.Unlock()
+
+	return call.err
+}
@@ -0,0 +1,234 @@
+package tce
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memFileSystem is a FileSystem holding its files in memory. It has no real
+// directories: every path is valid, and MkdirAll does nothing.
+type memFileSystem struct {
+	files map[string]*memData
+	temps int
+	mutex sync.Mutex
+}
+
+type memData struct {
+	content []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newMemFileSystem() *memFileSystem {
+	return &memFileSystem{files: map[string]*memData{}}
+}
+
+// add stores a file with the given content, modified at modTime.
+func (fileSystem *memFileSystem) add(name string, content string, modTime time.Time) {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	fileSystem.files[filepath.Clean(name)] = &memData{[]byte(content), 0644, modTime}
+}
+
+func (fileSystem *memFileSystem) Open(name string) (File, error) {
+	return fileSystem.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fileSystem *memFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	data, ok := fileSystem.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+
+		data = &memData{mode: perm, modTime: time.Now()}
+		fileSystem.files[name] = data
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		data.content = nil
+	}
+
+	return &memFile{name: name, data: data}, nil
+}
+
+func (fileSystem *memFileSystem) CreateTemp(dir string, pattern string) (File, error) {
+	fileSystem.mutex.Lock()
+	fileSystem.temps++
+	name := filepath.Join(dir, strings.Replace(pattern, "*", strconv.Itoa(fileSystem.temps), 1))
+	fileSystem.mutex.Unlock()
+
+	return fileSystem.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+func (fileSystem *memFileSystem) Stat(name string) (os.FileInfo, error) {
+	file, err := fileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return file.Stat()
+}
+
+func (fileSystem *memFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	entries := []os.DirEntry{}
+	for path, data := range fileSystem.files {
+		if filepath.Dir(path) == filepath.Clean(name) {
+			entries = append(entries, fs.FileInfoToDirEntry(memInfo{filepath.Base(path), data}))
+		}
+	}
+
+	return entries, nil
+}
+
+func (fileSystem *memFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (fileSystem *memFileSystem) Remove(name string) error {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := fileSystem.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+
+	delete(fileSystem.files, name)
+	return nil
+}
+
+func (fileSystem *memFileSystem) Rename(oldPath string, newPath string) error {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	data, ok := fileSystem.files[oldPath]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldPath, Err: fs.ErrNotExist}
+	}
+
+	delete(fileSystem.files, oldPath)
+	fileSystem.files[newPath] = data
+	return nil
+}
+
+func (fileSystem *memFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	data, ok := fileSystem.files[filepath.Clean(name)]
+	if !ok {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+
+	data.modTime = mtime
+	return nil
+}
+
+// memFile is a File open on a memFileSystem. Files are not locked against
+// each other, which is enough for tests that only use one at a time.
+type memFile struct {
+	name   string
+	data   *memData
+	offset int64
+}
+
+func (file *memFile) Read(p []byte) (int, error) {
+	n, err := file.ReadAt(p, file.offset)
+	file.offset += int64(n)
+	return n, err
+}
+
+func (file *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= int64(len(file.data.content)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, file.data.content[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (file *memFile) Write(p []byte) (int, error) {
+	end := file.offset + int64(len(p))
+	if end > int64(len(file.data.content)) {
+		file.data.content = append(file.data.content, make([]byte, end-int64(len(file.data.content)))...)
+	}
+
+	copy(file.data.content[file.offset:], p)
+	file.offset = end
+	file.data.modTime = time.Now()
+	return len(p), nil
+}
+
+func (file *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += file.offset
+	case io.SeekEnd:
+		offset += int64(len(file.data.content))
+	}
+
+	file.offset = offset
+	return offset, nil
+}
+
+func (file *memFile) Close() error {
+	return nil
+}
+
+func (file *memFile) Name() string {
+	return file.name
+}
+
+func (file *memFile) Stat() (os.FileInfo, error) {
+	return memInfo{filepath.Base(file.name), file.data}, nil
+}
+
+func (file *memFile) Sync() error {
+	return nil
+}
+
+func (file *memFile) Truncate(size int64) error {
+	if size > int64(len(file.data.content)) {
+		file.data.content = append(file.data.content, make([]byte, size-int64(len(file.data.content)))...)
+	}
+
+	file.data.content = file.data.content[:size]
+	return nil
+}
+
+func (file *memFile) Chmod(mode os.FileMode) error {
+	file.data.mode = mode
+	return nil
+}
+
+type memInfo struct {
+	name string
+	data *memData
+}
+
+func (info memInfo) Name() string       { return info.name }
+func (info memInfo) Size() int64        { return int64(len(info.data.content)) }
+func (info memInfo) Mode() os.FileMode  { return info.data.mode }
+func (info memInfo) ModTime() time.Time { return info.data.modTime }
+func (info memInfo) IsDir() bool        { return false }
+func (info memInfo) Sys() interface{}   { return nil }
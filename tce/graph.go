@@ -0,0 +1,102 @@
+package tce
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// GraphNode describes an extension in a resolved dependency graph, along
+// with whether it is present locally and its checksum, if one is present.
+type GraphNode struct {
+	Name         string   `json:"-"`
+	Dependencies []string `json:"dependencies"`
+	Present      bool     `json:"present"`
+	Checksum     string   `json:"checksum,omitempty"`
+}
+
+// Graph returns the given extensions and everything they depend on, each
+// with its direct dependencies, ordered so that dependencies come first.
+func (client *Client) Graph(extensions []string) []GraphNode {
+	nodes := []GraphNode{}
+	for _, name := range client.LoadOrder(extensions) {
+		dependencies := client.Dependencies(name)
+		if dependencies == nil {
+			dependencies = []string{}
+		}
+
+		info, err := client.options.FileSystem.Stat(client.FilePath(name + ".tcz"))
+		present := err == nil && info.Size() > 0
+
+		nodes = append(nodes, GraphNode{name, dependencies, present, client.localChecksum(name)})
+	}
+
+	return nodes
+}
+
+// localChecksum returns the checksum of an extension from the checksum file
+// already in the base directory, without downloading it.
+func (client *Client) localChecksum(name string) string {
+	algorithms := []HashAlgorithm{client.options.Hash}
+	if client.options.Hash.New == nil {
+		algorithms = autoHashAlgorithms
+	}
+
+	for _, algorithm := range algorithms {
+		file, err := client.options.FileSystem.Open(client.FilePath(name + ".tcz" + algorithm.Suffix))
+		if err != nil {
+			continue
+		}
+
+		checksum, err := parseChecksum(file, name+".tcz", algorithm)
+		file.Close()
+		if err == nil && checksum != "" {
+			return checksum
+		}
+	}
+
+	return ""
+}
+
+// WriteDot writes a dependency graph to path in Graphviz DOT format,
+// replacing the file atomically.
+func WriteDot(path string, nodes []GraphNode) error {
+	return writeAtomically(OSFileSystem{}, path, 0644, func(writer io.Writer) error {
+		_, err := fmt.Fprintln(writer, "digraph dependencies {")
+		if err != nil {
+			return err
+		}
+
+		for _, node := range nodes {
+			_, err = fmt.Fprintf(writer, "\t%q;\n", node.Name)
+			if err != nil {
+				return err
+			}
+
+			for _, dependency := range node.Dependencies {
+				_, err = fmt.Fprintf(writer, "\t%q -> %q;\n", node.Name, dependency)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		_, err = fmt.Fprintln(writer, "}")
+		return err
+	})
+}
+
+// WriteGraphJSON writes a dependency graph to path as a JSON object mapping
+// each extension to its node, replacing the file atomically.
+func WriteGraphJSON(path string, nodes []GraphNode) error {
+	graph := map[string]GraphNode{}
+	for _, node := range nodes {
+		graph[node.Name] = node
+	}
+
+	return writeAtomically(OSFileSystem{}, path, 0644, func(writer io.Writer) error {
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(graph)
+	})
+}
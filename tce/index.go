@@ -0,0 +1,296 @@
+package tce
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The mirror publishes a list of every extension in a repository, and a list
+// of their sizes, which are cached in the base directory.
+const (
+	IndexFile = "info.lst.gz"
+	SizesFile = "sizelist.gz"
+)
+
+// IndexEntry describes an extension listed in the repository index. Size is
+// -1 if the mirror does not publish it.
+type IndexEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Index returns every extension in the repository, sorted by name, reading
+// the index cached in the base directory or downloading it if it is absent,
+// or with DryRun reading it from the mirror without saving it.
+func (client *Client) Index(ctx context.Context) ([]IndexEntry, error) {
+	index, err := client.loadIndex(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]IndexEntry, 0, len(index))
+	for name, size := range index {
+		entries = append(entries, IndexEntry{name, size})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	return entries, nil
+}
+
+// Search returns the extensions in the repository index whose names match
+// query, ignoring case. The query matches anywhere in a name, unless it holds
+// any of the glob characters *, ? or [, in which case it must match the whole
+// name, e.g. "gtk*".
+func (client *Client) Search(ctx context.Context, query string) ([]IndexEntry, error) {
+	query = strings.ToLower(query)
+	glob := strings.ContainsAny(query, "*?[")
+	if glob {
+		_, err := path.Match(query, "")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern: %v", query)
+		}
+	}
+
+	entries, err := client.Index(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []IndexEntry{}
+	for _, entry := range entries {
+		name := strings.ToLower(entry.Name)
+
+		matched := strings.Contains(name, query)
+		if glob {
+			matched, _ = path.Match(query, name)
+		}
+
+		if matched {
+			matches = append(matches, entry)
+		}
+	}
+
+	return matches, nil
+}
+
+// MatchCase returns the name of the extension in the repository index that
+// matches name ignoring case, getting the index as Index does, e.g.
+// "firefox" for "Firefox". The name is returned as is if the index has it
+// exactly, if it matches no extension or several, or if it holds the KERNEL
+// token.
+func (client *Client) MatchCase(ctx context.Context, name string) (string, error) {
+	name = NormalizeName(name)
+	if strings.Contains(name, "KERNEL") {
+		return name, nil
+	}
+
+	index, err := client.loadIndex(ctx, true)
+	if err != nil {
+		return name, err
+	}
+
+	if _, ok := index[name]; ok {
+		return name, nil
+	}
+
+	matches := []string{}
+	for entry := range index {
+		if strings.EqualFold(entry, name) {
+			matches = append(matches, entry)
+		}
+	}
+
+	if len(matches) != 1 {
+		return name, nil
+	}
+
+	return matches[0], nil
+}
+
+// Listed returns true if name is in the repository index cached in the base
+// directory. It never downloads the index, returning false if it is absent.
+func (client *Client) Listed(ctx context.Context, name string) bool {
+	index, err := client.loadIndex(ctx, false)
+	if err != nil {
+		return false
+	}
+
+	_, ok := index[name]
+	return ok
+}
+
+// Description returns the one-line description from the .info file of an
+// extension, or an empty string if it has none. The file is read from the
+// base directory if present, and from the mirror otherwise without saving it.
+func (client *Client) Description(ctx context.Context, name string) (string, error) {
+	file, err := client.peekFile(ctx, name+".tcz.info")
+	if err != nil || file == nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		field, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(field) == "Description" {
+			return strings.TrimSpace(value), nil
+		}
+	}
+
+	return "", scanner.Err()
+}
+
+// UpdateIndex downloads the repository index again, replacing the copy
+// cached in the base directory.
+func (client *Client) UpdateIndex(ctx context.Context) error {
+	for _, fileName := range []string{IndexFile, SizesFile} {
+		err := client.downloadIndexFile(ctx, fileName)
+		if err != nil {
+			return err
+		}
+	}
+
+	client.indexMutex.Lock()
+	client.index = nil
+	client.indexMutex.Unlock()
+
+	return nil
+}
+
+func (client *Client) downloadIndexFile(ctx context.Context, fileName string) error {
+	unlock := client.lockFile(fileName)
+	defer unlock()
+
+	filePath := client.FilePath(fileName)
+	line := client.newStatusLine()
+	line.Printf("Downloading %v", fileName)
+	line.Verbosef(" (%v)", filePath)
+	line.Printf("... ")
+
+	file, err := client.retryDownload(ctx, line, fileName, filePath, "", time.Time{})
+	if err != nil {
+		return err
+	}
+
+	if file != nil {
+		file.Close()
+	}
+
+	return nil
+}
+
+// loadIndex returns the repository index, mapping each extension to its size.
+// Unless download is set, it returns nil if the index is not cached.
+func (client *Client) loadIndex(ctx context.Context, download bool) (map[string]int64, error) {
+	client.indexMutex.Lock()
+	defer client.indexMutex.Unlock()
+
+	if client.index != nil {
+		return client.index, nil
+	}
+
+	names, err := client.readIndexFile(ctx, IndexFile, download)
+	if err != nil {
+		return nil, err
+	}
+
+	if names == nil {
+		if download {
+			return nil, fmt.Errorf("No index published for %v/%v", client.options.Version, client.options.Arch)
+		}
+
+		return nil, nil
+	}
+
+	index := map[string]int64{}
+	for _, fields := range names {
+		index[strings.TrimSuffix(fields[0], ".tcz")] = -1
+	}
+
+	sizes, err := client.readIndexFile(ctx, SizesFile, download)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fields := range sizes {
+		name := strings.TrimSuffix(fields[0], ".tcz")
+		if _, ok := index[name]; !ok || len(fields) < 2 {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil {
+			index[name] = size
+		}
+	}
+
+	client.index = index
+	return index, nil
+}
+
+// readIndexFile returns the fields of each line of a gzipped index file, or
+// nil if the mirror does not publish it or, unless download is set, if it is
+// not cached. With DryRun, a download is read without saving it.
+func (client *Client) readIndexFile(ctx context.Context, fileName string, download bool) ([][]string, error) {
+	var file io.ReadCloser
+	var err error
+	if download && client.options.DryRun {
+		file, err = client.peekFile(ctx, fileName)
+	} else if download {
+		file, err = client.openFile(ctx, fileName, "")
+	} else {
+		file, err = client.options.FileSystem.Open(client.FilePath(fileName))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if file == nil {
+		return nil, nil
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err == io.EOF {
+		// An empty marker left for a file the mirror does not have.
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %v: %v", fileName, err)
+	}
+	defer reader.Close()
+
+	lines := [][]string{}
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			lines = append(lines, fields)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %v: %v", fileName, err)
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,20 @@
+package tce
+
+import (
+	"errors"
+	"path/filepath"
+)
+
+// LockFile is the name of the lock file LockDirectory creates.
+const LockFile = ".tce.lock"
+
+// ErrLocked is returned by LockDirectory when another process holds the lock.
+var ErrLocked = errors.New("Directory is locked by another process")
+
+// LockDirectory takes an advisory lock on a base directory, so that runs
+// sharing it do not corrupt each other's downloads and state. It fails with
+// ErrLocked if another process holds the lock. Call the returned function to
+// release it.
+func LockDirectory(dir string) (func(), error) {
+	return acquireLock(filepath.Join(dir, LockFile))
+}
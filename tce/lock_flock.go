@@ -0,0 +1,36 @@
+//go:build linux || darwin
+
+package tce
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// acquireLock holds an flock on the lock file, which the kernel releases if
+// the process dies, so a stale lock file never blocks later runs.
+func acquireLock(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+
+		return nil, err
+	}
+
+	file.Truncate(0)
+	fmt.Fprintf(file, "%v\n", os.Getpid())
+
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux && !darwin
+
+package tce
+
+import (
+	"fmt"
+	"os"
+)
+
+// acquireLock creates the lock file exclusively and removes it on release. A
+// run that dies without releasing it leaves the file behind.
+func acquireLock(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, ErrLocked
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(file, "%v\n", os.Getpid())
+	file.Close()
+
+	return func() {
+		os.Remove(path)
+	}, nil
+}
@@ -0,0 +1,162 @@
+package tce
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// statusLine composes the messages about one file. When downloading
+// concurrently, text is only written once a line is complete, so that lines
+// about different files never interleave.
+type statusLine struct {
+	client *Client
+	buffer []byte
+	whole  bool
+	open   bool
+}
+
+func (client *Client) newStatusLine() *statusLine {
+	return &statusLine{client: client}
+}
+
+// newWholeStatusLine returns a status line that is only ever written whole,
+// as if Jobs were above 1, for work that runs concurrently regardless.
+func (client *Client) newWholeStatusLine() *statusLine {
+	return &statusLine{client: client, whole: true}
+}
+
+func (line *statusLine) Printf(format string, args ...interface{}) {
+	if line.client.options.LogLevel >= LogNormal {
+		line.write(fmt.Appendf(nil, format, args...))
+	}
+}
+
+func (line *statusLine) Println(args ...interface{}) {
+	if line.client.options.LogLevel >= LogNormal {
+		line.write(fmt.Appendln(nil, args...))
+	}
+}
+
+func (line *statusLine) Verbosef(format string, args ...interface{}) {
+	if line.client.options.LogLevel >= LogVerbose {
+		line.write(fmt.Appendf(nil, format, args...))
+	}
+}
+
+// finish ends the line if what was printed on it is unterminated, e.g. when a
+// line otherwise only printed verbosely notes a fallback to HTTP.
+func (line *statusLine) finish() {
+	if line.open {
+		line.Println()
+	}
+}
+
+func (line *statusLine) write(text []byte) {
+	if len(text) > 0 {
+		line.open = text[len(text)-1] != '\n'
+	}
+
+	line.buffer = append(line.buffer, text...)
+	line.flush()
+}
+
+func (line *statusLine) flush() {
+	n := len(line.buffer)
+	if line.client.options.Jobs > 1 || line.whole {
+		n = bytes.LastIndexByte(line.buffer, '\n') + 1
+	}
+
+	if n == 0 {
+		return
+	}
+
+	line.client.outputMutex.Lock()
+	line.client.options.Output.Write(line.buffer[:n])
+	line.client.outputMutex.Unlock()
+
+	line.buffer = line.buffer[:copy(line.buffer, line.buffer[n:])]
+}
+
+type progressBar struct {
+	line        *statusLine
+	transferred int64
+	total       int64
+	speed       float64
+	drawn       bool
+	lastDraw    time.Time
+	lastBytes   int64
+}
+
+func newProgressBar(line *statusLine, transferred int64, total int64) *progressBar {
+	return &progressBar{
+		line:        line,
+		transferred: transferred,
+		total:       total,
+		lastDraw:    time.Now(),
+		lastBytes:   transferred,
+	}
+}
+
+func (progress *progressBar) Write(p []byte) (int, error) {
+	progress.transferred += int64(len(p))
+
+	now := time.Now()
+	elapsed := now.Sub(progress.lastDraw)
+	if elapsed < 100*time.Millisecond {
+		return len(p), nil
+	}
+
+	speed := float64(progress.transferred-progress.lastBytes) / elapsed.Seconds()
+	if progress.speed == 0 {
+		progress.speed = speed
+	} else {
+		progress.speed = 0.7*progress.speed + 0.3*speed
+	}
+
+	progress.lastDraw = now
+	progress.lastBytes = progress.transferred
+	progress.draw()
+	return len(p), nil
+}
+
+func (progress *progressBar) draw() {
+	text := FormatSize(progress.transferred)
+	if progress.total > 0 {
+		text = fmt.Sprintf("%3d%% (%v / %v", 100*progress.transferred/progress.total, text, FormatSize(progress.total))
+	} else {
+		text = "(" + text
+	}
+	text += fmt.Sprintf(", %v/s)", FormatSize(int64(progress.speed)))
+
+	if progress.drawn {
+		progress.line.Printf("\x1b8\x1b[K%v", text)
+	} else {
+		progress.line.Printf("\x1b7%v", text)
+		progress.drawn = true
+	}
+}
+
+func (progress *progressBar) finish() {
+	if progress.drawn {
+		progress.line.Printf("\x1b8\x1b[K")
+	}
+}
+
+// FormatSize formats a number of bytes with a binary unit, e.g. "1.5 MiB".
+func FormatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%v %v", size, units[0])
+	}
+
+	return fmt.Sprintf("%.1f %v", value, units[unit])
+}
@@ -0,0 +1,103 @@
+package tce
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Manifest pins the exact extensions a run fetched, so that a later run can
+// insist on getting the same files.
+type Manifest struct {
+	Version    string          `json:"version"`
+	Arch       string          `json:"arch"`
+	Extensions []ManifestEntry `json:"extensions"`
+}
+
+// ManifestEntry records the checksum of an extension's .tcz file, the mirror
+// it was downloaded from and the URL that served it, which differs from the
+// mirror's after a redirect. For a file downloaded by an earlier run, these
+// come from the state file. They are left out when unknown, e.g. for a file
+// without a checksum that was already present, or one copied in by hand.
+type ManifestEntry struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	Hash      string `json:"hash"`
+	Mirror    string `json:"mirror,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// ManifestEntries returns manifest entries for the given extensions in the
+// base directories. The checksum recorded is the one each extension was
+// verified against or, for an extension without a published checksum, one
+// calculated from the local file with the configured algorithm, or SHA-256
+// with AutoHash.
+func (client *Client) ManifestEntries(names []string) ([]ManifestEntry, error) {
+	entries := []ManifestEntry{}
+	for _, name := range names {
+		fileName := name + ".tcz"
+
+		client.checkedMutex.Lock()
+		hash := client.checked[name]
+		client.checkedMutex.Unlock()
+
+		algorithm := client.hashAlgorithm(hash)
+		if hash == "" {
+			if client.options.Hash.New == nil {
+				algorithm = SHA256
+			}
+
+			file, err := client.options.FileSystem.Open(client.FilePath(fileName))
+			if err != nil {
+				return entries, err
+			}
+
+			digest := algorithm.New()
+			_, err = io.Copy(digest, file)
+			file.Close()
+			if err != nil {
+				return entries, err
+			}
+
+			hash = hex.EncodeToString(digest.Sum(nil))
+		}
+
+		source := client.recordedSource(fileName)
+		entries = append(entries, ManifestEntry{
+			Name:      name,
+			Algorithm: algorithm.Name,
+			Hash:      hash,
+			Mirror:    source.mirror,
+			URL:       source.url,
+		})
+	}
+
+	return entries, nil
+}
+
+// ReadManifest reads a manifest written by WriteManifest.
+func ReadManifest(path string) (Manifest, error) {
+	manifest := Manifest{}
+
+	data, err := readFile(OSFileSystem{}, path)
+	if err != nil {
+		return manifest, err
+	}
+
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return manifest, fmt.Errorf("Invalid manifest: %v", err)
+	}
+
+	return manifest, nil
+}
+
+// WriteManifest writes a manifest to path as JSON, replacing it atomically.
+func WriteManifest(path string, manifest Manifest) error {
+	return writeAtomically(OSFileSystem{}, path, 0644, func(writer io.Writer) error {
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(manifest)
+	})
+}
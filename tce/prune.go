@@ -0,0 +1,129 @@
+package tce
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func extensionName(fileName string) string {
+	i := strings.Index(fileName, ".tcz")
+	if i <= 0 {
+		return ""
+	}
+
+	return fileName[:i]
+}
+
+// Orphans returns the extensions with files in the base directories that
+// are not in keep.
+func (client *Client) Orphans(keep []string) ([]string, error) {
+	kept := map[string]struct{}{}
+	for _, name := range keep {
+		kept[name] = struct{}{}
+	}
+
+	orphans := []string{}
+	for _, directory := range client.directories() {
+		entries, err := client.options.FileSystem.ReadDir(directory)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			name := extensionName(entry.Name())
+			if name == "" || entry.IsDir() {
+				continue
+			}
+
+			if _, ok := kept[name]; !ok {
+				kept[name] = struct{}{}
+				orphans = append(orphans, name)
+			}
+		}
+	}
+
+	sort.Strings(orphans)
+	return orphans, nil
+}
+
+// RemoveExtension deletes an extension and its checksum, dependency and
+// partial download files from the base directories.
+func (client *Client) RemoveExtension(name string) error {
+	for _, directory := range client.directories() {
+		entries, err := client.options.FileSystem.ReadDir(directory)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if extensionName(entry.Name()) == name && !entry.IsDir() {
+				err = client.options.FileSystem.Remove(filepath.Join(directory, entry.Name()))
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Markers returns the paths of the empty files left in the base directories
+// in place of files the mirror does not have.
+func (client *Client) Markers() ([]string, error) {
+	markers := []string{}
+	for _, directory := range client.directories() {
+		entries, err := client.options.FileSystem.ReadDir(directory)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasSuffix(name, ".part") {
+				continue
+			}
+
+			if extensionName(name) == "" && name != IndexFile && name != SizesFile {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+
+			if info.Mode().IsRegular() && info.Size() == 0 {
+				markers = append(markers, filepath.Join(directory, name))
+			}
+		}
+	}
+
+	sort.Strings(markers)
+	return markers, nil
+}
+
+// RemoveMarker deletes a marker returned by Markers, unless it has since been
+// replaced by a real file.
+func (client *Client) RemoveMarker(path string) error {
+	info, err := client.options.FileSystem.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Size() > 0 {
+		return nil
+	}
+
+	return client.options.FileSystem.Remove(path)
+}
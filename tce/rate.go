@@ -0,0 +1,51 @@
+package tce
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+type rateLimiter struct {
+	mutex sync.Mutex
+	rate  int64
+	next  time.Time
+}
+
+func (limiter *rateLimiter) chunkSize() int {
+	size := limiter.rate / 10
+	if size < 1 {
+		return 1
+	}
+
+	return int(size)
+}
+
+func (limiter *rateLimiter) wait(n int) {
+	limiter.mutex.Lock()
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+
+	limiter.next = limiter.next.Add(time.Duration(n) * time.Second / time.Duration(limiter.rate))
+	delay := limiter.next.Sub(now)
+	limiter.mutex.Unlock()
+
+	time.Sleep(delay)
+}
+
+type throttledReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (reader *throttledReader) Read(p []byte) (int, error) {
+	if size := reader.limiter.chunkSize(); len(p) > size {
+		p = p[:size]
+	}
+
+	n, err := reader.reader.Read(p)
+	reader.limiter.wait(n)
+	return n, err
+}
@@ -0,0 +1,12 @@
+//go:build !plan9
+
+package tce
+
+import (
+	"errors"
+	"syscall"
+)
+
+func isConnectionReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
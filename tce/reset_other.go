@@ -0,0 +1,9 @@
+//go:build plan9
+
+package tce
+
+// isConnectionReset always returns false on Plan 9, which has no ECONNRESET
+// errno to check for.
+func isConnectionReset(err error) bool {
+	return false
+}
@@ -0,0 +1,445 @@
+package tce
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// getChecksum returns the published checksum of an extension, reading the
+// checksum file from the base directory or downloading it. If remote is set,
+// it is read from the mirror without touching the base directory instead.
+func (client *Client) getChecksum(ctx context.Context, name string, remote bool) (string, error) {
+	algorithms := []HashAlgorithm{client.options.Hash}
+	if client.options.Hash.New == nil {
+		algorithms = autoHashAlgorithms
+	}
+
+	for _, algorithm := range algorithms {
+		fileName := name + ".tcz" + algorithm.Suffix
+
+		var file io.ReadCloser
+		var err error
+		if remote {
+			line := client.newStatusLine()
+			line.Printf("Reading %v... ", fileName)
+			file, err = client.readRemoteFile(ctx, line, fileName)
+		} else {
+			file, err = client.openFile(ctx, fileName, "")
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if file != nil {
+			defer file.Close()
+			return parseChecksum(file, name+".tcz", algorithm)
+		}
+	}
+
+	return "", nil
+}
+
+// parseChecksum reads the digest for fileName from a checksum file, which may
+// hold a bare digest or lines in the "<digest>  <file>" format of md5sum.
+func parseChecksum(reader io.Reader, fileName string, algorithm HashAlgorithm) (string, error) {
+	digest, bare, named := "", "", false
+	scanner := bufio.NewScanner(reader)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) == 1:
+			if bare == "" {
+				bare = fields[0]
+			}
+		default:
+			named = true
+			// md5sum marks files read in binary mode with a leading '*'.
+			if digest == "" && path.Base(strings.TrimPrefix(fields[1], "*")) == fileName {
+				digest = fields[0]
+			}
+		}
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return "", err
+	}
+
+	if digest == "" {
+		digest = bare
+	}
+
+	if digest == "" {
+		if named {
+			return "", fmt.Errorf("No checksum for %v in its %v file", fileName, algorithm.Name)
+		}
+
+		return "", nil
+	}
+
+	digest = strings.ToLower(digest)
+	_, err = hex.DecodeString(digest)
+	if err != nil || len(digest) != algorithm.New().Size()*2 {
+		return "", fmt.Errorf("Invalid %v checksum for %v: %v", algorithm.Name, fileName, digest)
+	}
+
+	return digest, nil
+}
+
+func (client *Client) getDependencies(ctx context.Context, name string) ([]string, error) {
+	var file io.ReadCloser
+	var err error
+	if client.options.DryRun {
+		file, err = client.peekFile(ctx, name+".tcz.dep")
+	} else {
+		file, err = client.openFile(ctx, name+".tcz.dep", "")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if file == nil {
+		return []string{}, nil
+	}
+	defer file.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" {
+			line = strings.TrimSuffix(line, ".tcz")
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, nil
+}
+
+type resolution struct {
+	client   *Client
+	resolved map[string]int
+	expanded map[string][]string
+	stack    []string
+	names    []string
+	errs     []error
+	beyond   []string
+}
+
+func (client *Client) resolveExtension(ctx context.Context, name string) ([]string, error) {
+	r := &resolution{client: client, resolved: map[string]int{}, expanded: map[string][]string{}}
+
+	err := r.resolve(ctx, name, 0)
+	if err != nil {
+		r.errs = append(r.errs, err)
+	}
+
+	reported := map[string]struct{}{}
+	for _, dependency := range r.beyond {
+		_, resolved := r.resolved[dependency]
+		_, ok := reported[dependency]
+		if !resolved && !ok {
+			reported[dependency] = struct{}{}
+			line := client.newStatusLine()
+			line.Printf("Not fetching %v, beyond the maximum depth of %v.\n", dependency, client.options.MaxDepth)
+		}
+	}
+
+	if len(r.errs) > 0 && !client.options.KeepGoing {
+		return nil, r.errs[0]
+	}
+
+	return r.names, joinErrors(client.ExpandName(name), r.errs)
+}
+
+func (r *resolution) resolve(ctx context.Context, name string, depth int) error {
+	client := r.client
+	name = client.ExpandName(name)
+
+	for i, ancestor := range r.stack {
+		if ancestor == name {
+			cycle := append(append([]string{}, r.stack[i:]...), name)
+			return fmt.Errorf("Circular dependency: %v", strings.Join(cycle, " -> "))
+		}
+	}
+
+	// An extension reached again by a shorter path is expanded again, so that
+	// -max-depth counts the shortest path to each extension, not the first
+	// one walked.
+	previous, revisit := r.resolved[name]
+	if revisit && previous <= depth {
+		return nil
+	}
+	r.resolved[name] = depth
+
+	if revisit {
+		expanded, ok := r.expanded[name]
+		if !ok {
+			return nil
+		}
+
+		return r.expand(ctx, name, expanded, depth)
+	}
+
+	client.checkedMutex.Lock()
+	_, ok := client.checked[name]
+	client.checkedMutex.Unlock()
+
+	if client.isResolved(name) && client.options.DryRun {
+		ok = true
+	}
+
+	if ok {
+		return nil
+	}
+
+	r.names = append(r.names, name)
+	client.emit(Resolving{name})
+
+	if client.options.NoDeps {
+		client.setDependencies(name, []string{})
+		return nil
+	}
+
+	dependencies, err := client.getDependencies(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// The dependencies are sorted, so that reordering the lines of a .dep
+	// file changes nothing.
+	expanded := []string{}
+	seen := map[string]struct{}{}
+	for _, dependency := range dependencies {
+		dependency = client.ExpandName(dependency)
+		if _, ok := seen[dependency]; ok {
+			continue
+		}
+		seen[dependency] = struct{}{}
+
+		if _, ok := client.excluded[dependency]; ok {
+			line := client.newStatusLine()
+			line.Printf("Excluding %v, required by %v.\n", dependency, name)
+			continue
+		}
+
+		expanded = append(expanded, dependency)
+	}
+	sort.Strings(expanded)
+	r.expanded[name] = expanded
+
+	return r.expand(ctx, name, expanded, depth)
+}
+
+// expand records the dependencies of an extension and resolves them, unless
+// it is at the maximum depth.
+func (r *resolution) expand(ctx context.Context, name string, expanded []string, depth int) error {
+	client := r.client
+
+	if client.options.MaxDepth > 0 && depth >= client.options.MaxDepth {
+		r.beyond = append(r.beyond, expanded...)
+		client.setDependencies(name, []string{})
+		return nil
+	}
+	client.setDependencies(name, expanded)
+
+	r.stack = append(r.stack, name)
+	for _, dependency := range expanded {
+		err := r.resolve(ctx, dependency, depth+1)
+		if err != nil {
+			if !client.options.KeepGoing || ctx.Err() != nil || errors.Is(err, ErrUnreachable) {
+				return err
+			}
+
+			// Record the failure and carry on with the other dependencies.
+			r.errs = append(r.errs, err)
+		}
+	}
+	r.stack = r.stack[:len(r.stack)-1]
+
+	return nil
+}
+
+// Dependencies returns the direct dependencies of an extension the client
+// has already resolved.
+func (client *Client) Dependencies(name string) []string {
+	client.graphMutex.Lock()
+	defer client.graphMutex.Unlock()
+
+	return client.dependencyGraph[name]
+}
+
+func (client *Client) isResolved(name string) bool {
+	client.graphMutex.Lock()
+	defer client.graphMutex.Unlock()
+
+	_, ok := client.dependencyGraph[name]
+	return ok
+}
+
+func (client *Client) setDependencies(name string, dependencies []string) {
+	client.graphMutex.Lock()
+	defer client.graphMutex.Unlock()
+
+	client.dependencyGraph[name] = dependencies
+}
+
+// Closure returns every transitive dependency of an extension the client has
+// already resolved, in the order given by LoadOrder.
+func (client *Client) Closure(name string) []string {
+	closure := []string{}
+	for _, dependency := range client.LoadOrder([]string{name}) {
+		if dependency != name {
+			closure = append(closure, dependency)
+		}
+	}
+
+	return closure
+}
+
+// LoadOrder returns the given extensions and their dependencies ordered so
+// that every extension comes after everything it depends on. Extensions that
+// could come in either order are sorted by name, so the order depends only on
+// the dependency graph, not on the order of the requests or of the lines in
+// the .dep files. A circular dependency is broken at the first extension by
+// name that remains on a cycle, so that extensions which merely depend on a
+// cycle still come after it.
+func (client *Client) LoadOrder(extensions []string) []string {
+	nodes := map[string]struct{}{}
+
+	var collect func(name string)
+	collect = func(name string) {
+		if _, ok := nodes[name]; ok {
+			return
+		}
+		nodes[name] = struct{}{}
+
+		for _, dependency := range client.Dependencies(name) {
+			collect(dependency)
+		}
+	}
+
+	for _, extension := range extensions {
+		collect(client.ExpandName(extension))
+	}
+
+	// Count the dependencies of each extension that have yet to be placed.
+	pending := map[string]int{}
+	dependents := map[string][]string{}
+	for name := range nodes {
+		for _, dependency := range client.Dependencies(name) {
+			pending[name]++
+			dependents[dependency] = append(dependents[dependency], name)
+		}
+	}
+
+	ready := []string{}
+	for name := range nodes {
+		if pending[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	order := []string{}
+	placed := map[string]struct{}{}
+
+	// onCycle returns true if an extension depends on itself through the
+	// extensions that have yet to be placed.
+	onCycle := func(name string) bool {
+		seen := map[string]struct{}{}
+		stack := []string{name}
+		for len(stack) > 0 {
+			current := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			for _, dependency := range client.Dependencies(current) {
+				if dependency == name {
+					return true
+				}
+
+				_, isPlaced := placed[dependency]
+				_, isSeen := seen[dependency]
+				if !isPlaced && !isSeen {
+					seen[dependency] = struct{}{}
+					stack = append(stack, dependency)
+				}
+			}
+		}
+
+		return false
+	}
+
+	for len(order) < len(nodes) {
+		// Every extension left depends on one that is left, so following
+		// dependencies from any of them ends up on a cycle.
+		if len(ready) == 0 {
+			for name := range nodes {
+				if _, ok := placed[name]; !ok && (len(ready) == 0 || name < ready[0]) && onCycle(name) {
+					ready = []string{name}
+				}
+			}
+		}
+
+		sort.Strings(ready)
+		name := ready[0]
+		ready = ready[1:]
+
+		order = append(order, name)
+		placed[name] = struct{}{}
+
+		for _, dependent := range dependents[name] {
+			pending[dependent]--
+			if _, ok := placed[dependent]; !ok && pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	return order
+}
+
+// sortNames orders names as LoadOrder would, leaving out their dependencies
+// that are not among them.
+func (client *Client) sortNames(names []string) []string {
+	included := map[string]struct{}{}
+	for _, name := range names {
+		included[name] = struct{}{}
+	}
+
+	sorted := []string{}
+	for _, name := range client.LoadOrder(names) {
+		if _, ok := included[name]; ok {
+			sorted = append(sorted, name)
+		}
+	}
+
+	return sorted
+}
+
+// WriteOnboot writes the given extensions to path, one .tcz file name per
+// line, replacing the file atomically. Use LoadOrder to order them.
+func WriteOnboot(path string, names []string) error {
+	return writeAtomically(OSFileSystem{}, path, 0644, func(writer io.Writer) error {
+		for _, name := range names {
+			_, err := fmt.Fprintf(writer, "%v.tcz\n", name)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
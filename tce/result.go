@@ -0,0 +1,55 @@
+package tce
+
+// Result describes what a client did for an extension: the dependencies it
+// resolved, and the files it opened for the extension and each of them.
+type Result struct {
+	Name         string       `json:"name"`
+	Dependencies []string     `json:"dependencies"`
+	Files        []FileResult `json:"files"`
+}
+
+// FileResult describes one file of a Result. Status is as reported by
+// FileStatus, and Hash is the checksum a .tcz file was verified against, or ""
+// if it was not verified. A downloaded file also records the mirror it was
+// downloaded from and the URL that served it, after any redirects.
+type FileResult struct {
+	FileName string `json:"file"`
+	Status   string `json:"status"`
+	Hash     string `json:"hash,omitempty"`
+	Mirror   string `json:"mirror,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// Result returns what the client has done so far for an extension and its
+// dependencies, leaving out the files it has not opened.
+func (client *Client) Result(name string) Result {
+	name = client.ExpandName(name)
+	result := Result{
+		Name:         name,
+		Dependencies: client.Closure(name),
+		Files:        []FileResult{},
+	}
+
+	for _, extension := range append([]string{name}, result.Dependencies...) {
+		for _, suffix := range append([]string{""}, sidecarSuffixes...) {
+			fileName := extension + ".tcz" + suffix
+
+			status := client.FileStatus(fileName)
+			if status == "" {
+				continue
+			}
+
+			source := client.fileSource(fileName)
+			file := FileResult{FileName: fileName, Status: status, Mirror: source.mirror, URL: source.url}
+			if suffix == "" {
+				client.checkedMutex.Lock()
+				file.Hash = client.checked[extension]
+				client.checkedMutex.Unlock()
+			}
+
+			result.Files = append(result.Files, file)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+
+package tce
+
+func freeSpace(path string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package tce
+
+import "syscall"
+
+func freeSpace(path string) (int64, bool) {
+	var stat syscall.Statfs_t
+	if syscall.Statfs(path, &stat) != nil {
+		return 0, false
+	}
+
+	return int64(uint64(stat.Bavail) * uint64(stat.Bsize)), true
+}
@@ -0,0 +1,115 @@
+package tce
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+type fileState struct {
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	Algorithm string    `json:"algorithm"`
+	Hash      string    `json:"hash"`
+	Mirror    string    `json:"mirror,omitempty"`
+	URL       string    `json:"url,omitempty"`
+}
+
+func (client *Client) statePath() string {
+	return client.FilePath(client.options.StateFile)
+}
+
+func (client *Client) loadState() {
+	if client.options.StateFile == "" || client.options.Refresh {
+		return
+	}
+
+	data, err := readFile(client.options.FileSystem, client.statePath())
+	if err != nil {
+		return
+	}
+
+	files := map[string]fileState{}
+	if json.Unmarshal(data, &files) == nil {
+		client.state = files
+	}
+}
+
+func (client *Client) saveState() error {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	if !client.stateChanged || client.options.StateFile == "" || client.options.DryRun {
+		return nil
+	}
+
+	files := map[string]fileState{}
+	data, err := readFile(client.options.FileSystem, client.statePath())
+	if err == nil {
+		json.Unmarshal(data, &files)
+	}
+
+	// A file re-hashed with -refresh keeps the record of where it came from.
+	for fileName, state := range client.state {
+		previous := files[fileName]
+		if state.Mirror == "" && previous.Hash == state.Hash {
+			state.Mirror, state.URL = previous.Mirror, previous.URL
+		}
+
+		files[fileName] = state
+	}
+
+	err = writeAtomically(client.options.FileSystem, client.statePath(), client.options.FileMode, func(writer io.Writer) error {
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(files)
+	})
+
+	if err == nil {
+		client.stateChanged = false
+	}
+
+	return err
+}
+
+func (client *Client) isVerified(fileName string, info os.FileInfo, expectedHash string) bool {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	state, ok := client.state[fileName]
+	return ok && state.Size == info.Size() && state.ModTime.Equal(info.ModTime()) &&
+		state.Algorithm == client.hashAlgorithm(expectedHash).Name && state.Hash == expectedHash
+}
+
+// recordVerified records a verified file, along with where it was downloaded
+// from, which is kept from the earlier record if the file was already present.
+func (client *Client) recordVerified(fileName string, info os.FileInfo, hash string) {
+	source := client.fileSource(fileName)
+
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	previous := client.state[fileName]
+	if source.mirror == "" && previous.Hash == hash {
+		source = fileSource{previous.Mirror, previous.URL}
+	}
+
+	client.state[fileName] = fileState{info.Size(), info.ModTime(), client.hashAlgorithm(hash).Name, hash, source.mirror, source.url}
+	client.stateChanged = true
+}
+
+// recordedSource returns where a file was downloaded from, in this run or, as
+// recorded in the state file, an earlier one.
+func (client *Client) recordedSource(fileName string) fileSource {
+	source := client.fileSource(fileName)
+	if source.mirror != "" {
+		return source
+	}
+
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	state := client.state[fileName]
+	return fileSource{state.Mirror, state.URL}
+}
@@ -0,0 +1,145 @@
+package tce
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Transfer records the download of one file: how many bytes were received and
+// how long receiving them took, excluding any local checks before or after.
+type Transfer struct {
+	FileName string        `json:"file"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Rate returns the throughput of the transfer in bytes per second.
+func (transfer Transfer) Rate() float64 {
+	if transfer.Duration <= 0 {
+		return 0
+	}
+
+	return float64(transfer.Bytes) / transfer.Duration.Seconds()
+}
+
+// TransferStats aggregates a set of transfers. The average rate is the total
+// size over the total time spent transferring, and the peak rate is that of
+// the fastest single transfer, both in bytes per second.
+type TransferStats struct {
+	Files       int           `json:"files"`
+	Bytes       int64         `json:"bytes"`
+	Duration    time.Duration `json:"duration"`
+	AverageRate float64       `json:"averageRate"`
+	PeakRate    float64       `json:"peakRate"`
+	Transfers   []Transfer    `json:"transfers"`
+}
+
+// SummarizeTransfers aggregates the given transfers, e.g. those of several
+// clients.
+func SummarizeTransfers(transfers []Transfer) TransferStats {
+	stats := TransferStats{Transfers: append([]Transfer{}, transfers...)}
+
+	for _, transfer := range transfers {
+		stats.Files++
+		stats.Bytes += transfer.Bytes
+		stats.Duration += transfer.Duration
+
+		if transfer.Rate() > stats.PeakRate {
+			stats.PeakRate = transfer.Rate()
+		}
+	}
+
+	if stats.Duration > 0 {
+		stats.AverageRate = float64(stats.Bytes) / stats.Duration.Seconds()
+	}
+
+	return stats
+}
+
+// Transfers returns every file the client has downloaded so far, in the order
+// the downloads finished.
+func (client *Client) Transfers() []Transfer {
+	client.transfersMutex.Lock()
+	defer client.transfersMutex.Unlock()
+
+	return append([]Transfer{}, client.transfers...)
+}
+
+func (client *Client) recordTransfer(fileName string, bytes int64, duration time.Duration) {
+	client.transfersMutex.Lock()
+	defer client.transfersMutex.Unlock()
+
+	client.transfers = append(client.transfers, Transfer{fileName, bytes, duration})
+}
+
+// DirectoryStats summarizes what the base directories hold: the extensions
+// present and the total size of their .tcz files, the absence markers, and
+// the extensions without a checksum file.
+type DirectoryStats struct {
+	Extensions      int      `json:"extensions"`
+	Bytes           int64    `json:"bytes"`
+	Markers         int      `json:"markers"`
+	WithoutChecksum []string `json:"withoutChecksum"`
+}
+
+// DirectoryStats walks the base directories and summarizes them, without
+// making any requests.
+func (client *Client) DirectoryStats() (DirectoryStats, error) {
+	stats := DirectoryStats{WithoutChecksum: []string{}}
+
+	for _, directory := range client.directories() {
+		entries, err := client.options.FileSystem.ReadDir(directory)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return stats, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".tcz") {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return stats, err
+			}
+
+			if info.Size() == 0 {
+				continue
+			}
+
+			stats.Extensions++
+			stats.Bytes += info.Size()
+
+			if !client.hasChecksum(filepath.Join(directory, entry.Name())) {
+				stats.WithoutChecksum = append(stats.WithoutChecksum, strings.TrimSuffix(entry.Name(), ".tcz"))
+			}
+		}
+	}
+
+	markers, err := client.Markers()
+	if err != nil {
+		return stats, err
+	}
+	stats.Markers = len(markers)
+
+	sort.Strings(stats.WithoutChecksum)
+	return stats, nil
+}
+
+func (client *Client) hasChecksum(path string) bool {
+	for _, algorithm := range autoHashAlgorithms {
+		info, err := client.options.FileSystem.Stat(path + algorithm.Suffix)
+		if err == nil && info.Size() > 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,203 @@
+package tce
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	VerifyOK         = "ok"
+	VerifyMismatch   = "mismatch"
+	VerifyNoChecksum = "no-checksum"
+	VerifyMissing    = "missing"
+)
+
+// VerifyResult describes the state of one extension in the base directory.
+type VerifyResult struct {
+	Name       string   `json:"name"`
+	Status     string   `json:"status"`
+	RequiredBy []string `json:"requiredBy,omitempty"`
+}
+
+// Verify checks every extension already present in the base directories
+// against its published checksum, reading the checksum file from the base
+// directory or downloading it if needed. Dependencies listed in local .dep
+// files that are not present are reported as missing. Extensions are hashed
+// by as many workers as Options.Jobs, but reported in order of name.
+func (client *Client) Verify(ctx context.Context) ([]VerifyResult, error) {
+	names, err := client.presentExtensions()
+	if err != nil {
+		return nil, err
+	}
+
+	present := map[string]struct{}{}
+	for _, name := range names {
+		present[name] = struct{}{}
+	}
+
+	statuses, errs := client.verifyExtensions(ctx, names)
+
+	results := []VerifyResult{}
+	requiredBy := map[string][]string{}
+
+	for i, name := range names {
+		if errs[i] != nil {
+			return results, errs[i]
+		}
+
+		results = append(results, VerifyResult{Name: name, Status: statuses[i]})
+
+		dependencies, err := client.readLocalDependencies(name)
+		if err != nil {
+			return results, err
+		}
+
+		for _, dependency := range dependencies {
+			if _, ok := present[dependency]; !ok {
+				requiredBy[dependency] = append(requiredBy[dependency], name)
+			}
+		}
+	}
+
+	missing := make([]string, 0, len(requiredBy))
+	for name := range requiredBy {
+		missing = append(missing, name)
+	}
+	sort.Strings(missing)
+
+	for _, name := range missing {
+		results = append(results, VerifyResult{Name: name, Status: VerifyMissing, RequiredBy: requiredBy[name]})
+	}
+
+	return results, nil
+}
+
+func (client *Client) verifyExtensions(ctx context.Context, names []string) ([]string, []error) {
+	statuses := make([]string, len(names))
+	errs := make([]error, len(names))
+	var wait sync.WaitGroup
+
+	queue := make(chan int)
+
+	for i := 0; i < client.options.Jobs; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+
+			for j := range queue {
+				statuses[j], errs[j] = client.verifyExtension(ctx, names[j])
+			}
+		}()
+	}
+
+	for i := range names {
+		queue <- i
+	}
+	close(queue)
+
+	wait.Wait()
+	return statuses, errs
+}
+
+// presentExtensions returns the extensions whose .tcz files are present in
+// the base directories, sorted by name.
+func (client *Client) presentExtensions() ([]string, error) {
+	paths := []string{}
+	for _, directory := range client.directories() {
+		entries, err := client.options.FileSystem.ReadDir(directory)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), ".tcz") && !entry.IsDir() {
+				paths = append(paths, filepath.Join(directory, entry.Name()))
+			}
+		}
+	}
+
+	names := []string{}
+	for _, path := range paths {
+		info, err := client.options.FileSystem.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimSuffix(filepath.Base(path), ".tcz")
+		if info.Size() > 0 && client.FilePath(name+".tcz") == path {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (client *Client) verifyExtension(ctx context.Context, name string) (string, error) {
+	expectedHash, err := client.getChecksum(ctx, name, false)
+	if err != nil {
+		return "", err
+	}
+
+	line := client.newStatusLine()
+	line.Printf("Verifying %v.tcz... ", name)
+
+	if expectedHash == "" {
+		line.Println("No checksum!")
+		return VerifyNoChecksum, nil
+	}
+
+	file, err := client.options.FileSystem.Open(client.FilePath(name + ".tcz"))
+	if err != nil {
+		line.Println("Failed!")
+		return "", err
+	}
+	defer file.Close()
+
+	actualHash, err := client.calculateHash(file, expectedHash)
+	if err != nil {
+		line.Println("Failed!")
+		return "", err
+	}
+
+	if client.compareHash(line, name+".tcz", actualHash, expectedHash) != nil {
+		line.Println("Mismatch!")
+		return VerifyMismatch, nil
+	}
+
+	line.Println("OK!")
+	return VerifyOK, nil
+}
+
+func (client *Client) readLocalDependencies(name string) ([]string, error) {
+	file, err := client.options.FileSystem.Open(client.FilePath(name + ".tcz.dep"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dependencies := []string{}
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			dependencies = append(dependencies, client.ExpandName(strings.TrimSuffix(line, ".tcz")))
+		}
+	}
+
+	return dependencies, scanner.Err()
+}